@@ -4,23 +4,56 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/arjungandhi/messages/pkg/config"
 	"github.com/arjungandhi/messages/pkg/messages"
 	"github.com/charmbracelet/huh"
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
+	"go.mau.fi/util/exmime"
+	"maunium.net/go/mautrix"
 )
 
 var accountFlag string
 var verboseFlag bool
 var outputFlag string
+var formatFlag string
+var replyToFlag string
+var threadIDFlag string
+var fileFlag string
+var roomFlag string
+var destFlag string
+var forceFlag bool
+var limitFlag int
+var sinceFlag string
+var beforeFlag string
+var resumeFlag bool
+var reactionsFlag bool
+var reasonFlag string
+var sendOutputFlag string
+var concurrencyFlag int
+var rateFlag float64
+var globalRateFlag float64
+var loginFlag string
+var homeserverFlag string
+var userIDFlag string
+var accessTokenFileFlag string
+var passwordStdinFlag bool
+var yesFlag bool
+var replaceFlag bool
 
 var rootCmd = &cobra.Command{
 	Use:   "messages",
@@ -61,40 +94,63 @@ var accountAddCmd = &cobra.Command{
 			return fmt.Errorf("account %q already exists", name)
 		}
 
-		var homeserverURL, userID, accessToken string
-		form := huh.NewForm(
-			huh.NewGroup(
-				huh.NewNote().
-					Title("Matrix Setup").
-					Description("Enter your Matrix homeserver details and access token."),
-			),
-			huh.NewGroup(
-				huh.NewInput().Title("Homeserver URL").Value(&homeserverURL).
-					Placeholder("https://matrix.example.com").
-					Validate(func(s string) error {
-						if strings.TrimSpace(s) == "" {
-							return fmt.Errorf("required")
-						}
-						return nil
-					}),
-				huh.NewInput().Title("User ID").Value(&userID).
-					Placeholder("@user:example.com").
-					Validate(func(s string) error {
-						if strings.TrimSpace(s) == "" {
-							return fmt.Errorf("required")
-						}
-						return nil
-					}),
-				huh.NewInput().Title("Access Token").Value(&accessToken).Password(true).
-					Validate(func(s string) error {
-						if strings.TrimSpace(s) == "" {
-							return fmt.Errorf("required")
-						}
-						return nil
-					}),
-			),
-		)
-		if err := form.Run(); err != nil {
+		login, err := accountLoginFromFlags()
+		if err != nil {
+			return err
+		}
+		homeserver := login.homeserver
+		if homeserver == "" {
+			homeserver = login.user
+		}
+		if homeserver == "" {
+			if !login.interactive {
+				return fmt.Errorf("--homeserver or --user-id is required when stdin is not a terminal")
+			}
+			form := huh.NewForm(
+				huh.NewGroup(
+					huh.NewNote().
+						Title("Matrix Setup").
+						Description("Enter your Matrix user ID or homeserver, then log in with your password, single sign-on or an access token."),
+				),
+				huh.NewGroup(
+					huh.NewInput().Title("User ID or homeserver").Value(&homeserver).
+						Placeholder("@user:example.com or https://matrix.example.com").
+						Validate(required),
+				),
+			)
+			if err := form.Run(); err != nil {
+				return err
+			}
+			homeserver = strings.TrimSpace(homeserver)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+		homeserverURL, err := messages.ResolveHomeserver(ctx, homeserver)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Using homeserver %s\n", homeserverURL)
+		// A user ID entered to discover the homeserver is also the login.
+		if login.user == "" && strings.HasPrefix(homeserver, "@") {
+			login.user = homeserver
+		}
+		method := loginFlag
+		switch {
+		case method != "":
+		case login.password != "":
+			method = "password"
+		case login.accessToken != "":
+			method = "token"
+		case login.interactive:
+			if method, err = selectLoginMethod(ctx, homeserverURL); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("no credentials given: use --password-stdin, --access-token-file or --login sso")
+		}
+		creds, err := loginAccount(ctx, homeserverURL, method, login)
+		if err != nil {
 			return err
 		}
 
@@ -107,11 +163,7 @@ var accountAddCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		if err := p.SaveCredentials(&messages.MatrixCredentials{
-			HomeserverURL: strings.TrimSpace(homeserverURL),
-			UserID:        strings.TrimSpace(userID),
-			AccessToken:   strings.TrimSpace(accessToken),
-		}); err != nil {
+		if err := p.SaveCredentials(creds); err != nil {
 			return err
 		}
 
@@ -124,7 +176,7 @@ var accountAddCmd = &cobra.Command{
 		if err := cfg.Save(); err != nil {
 			return err
 		}
-		fmt.Fprintf(os.Stderr, "Account %q added.\n", name)
+		fmt.Fprintf(os.Stderr, "Account %q added for %s (device %s).\n", name, creds.UserID, creds.DeviceID)
 		if cfg.Default == name {
 			fmt.Fprintf(os.Stderr, "Set as default account.\n")
 		}
@@ -132,6 +184,136 @@ var accountAddCmd = &cobra.Command{
 	},
 }
 
+// required validates that a form input is not blank.
+func required(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return fmt.Errorf("required")
+	}
+	return nil
+}
+
+// selectLoginMethod asks which of the login methods supported by the
+// homeserver to use. Logging in with an access token is always offered.
+func selectLoginMethod(ctx context.Context, homeserverURL string) (string, error) {
+	flows, err := messages.LoginFlows(ctx, homeserverURL)
+	if err != nil {
+		return "", err
+	}
+	var options []huh.Option[string]
+	if slices.Contains(flows, mautrix.AuthTypePassword) {
+		options = append(options, huh.NewOption("Password", "password"))
+	}
+	if slices.Contains(flows, mautrix.AuthTypeSSO) {
+		options = append(options, huh.NewOption("Single sign-on (browser)", "sso"))
+	}
+	options = append(options, huh.NewOption("Access token", "token"))
+	var method string
+	err = huh.NewSelect[string]().Title("Login method").Options(options...).Value(&method).Run()
+	return method, err
+}
+
+// accountLogin holds the login details for account add given by flags or
+// the environment. Anything missing is asked for if stdin is a terminal.
+type accountLogin struct {
+	homeserver  string
+	user        string
+	password    string
+	accessToken string
+	interactive bool
+}
+
+// accountLoginFromFlags reads the login details for account add from its
+// flags, falling back to MESSAGES_* environment variables.
+func accountLoginFromFlags() (*accountLogin, error) {
+	login := &accountLogin{
+		homeserver:  flagOrEnv(homeserverFlag, "MESSAGES_HOMESERVER"),
+		user:        flagOrEnv(userIDFlag, "MESSAGES_USER_ID"),
+		password:    os.Getenv("MESSAGES_PASSWORD"),
+		accessToken: os.Getenv("MESSAGES_ACCESS_TOKEN"),
+		interactive: stdinIsTerminal(),
+	}
+	if passwordStdinFlag {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		login.password = strings.TrimRight(password, "\r\n")
+		// stdin is used up, so there is nothing left to prompt with.
+		login.interactive = false
+	}
+	if path := flagOrEnv(accessTokenFileFlag, "MESSAGES_ACCESS_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read access token file: %w", err)
+		}
+		login.accessToken = strings.TrimSpace(string(data))
+	}
+	return login, nil
+}
+
+// flagOrEnv returns the flag value, or the environment variable if the flag
+// is unset.
+func flagOrEnv(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+// stdinIsTerminal reports whether stdin is a terminal that forms can be shown
+// on, rather than a pipe or /dev/null as in Docker, CI or a system service.
+func stdinIsTerminal() bool {
+	return isatty.IsTerminal(os.Stdin.Fd())
+}
+
+// loginAccount logs in to the homeserver with the given method, prompting
+// for anything login is missing, and returns the credentials of the new
+// device.
+func loginAccount(ctx context.Context, homeserverURL, method string, login *accountLogin) (*messages.MatrixCredentials, error) {
+	switch method {
+	case "password":
+		var fields []huh.Field
+		if login.user == "" {
+			fields = append(fields, huh.NewInput().Title("User ID").Value(&login.user).
+				Placeholder("@user:example.com").
+				Validate(required))
+		}
+		if login.password == "" {
+			fields = append(fields, huh.NewInput().Title("Password").Value(&login.password).Password(true).
+				Validate(required))
+		}
+		if len(fields) > 0 {
+			if !login.interactive {
+				return nil, fmt.Errorf("password login needs --user-id and --password-stdin when stdin is not a terminal")
+			}
+			if err := huh.NewForm(huh.NewGroup(fields...)).Run(); err != nil {
+				return nil, err
+			}
+		}
+		return messages.LoginPassword(ctx, homeserverURL, strings.TrimSpace(login.user), login.password)
+	case "sso":
+		return messages.LoginSSO(ctx, homeserverURL, func(url string) {
+			fmt.Fprintf(os.Stderr, "Open this URL in your browser to log in:\n\n  %s\n\n", url)
+		})
+	case "token":
+		if login.accessToken == "" {
+			if !login.interactive {
+				return nil, fmt.Errorf("token login needs --access-token-file when stdin is not a terminal")
+			}
+			form := huh.NewForm(huh.NewGroup(
+				huh.NewInput().Title("Access Token").Value(&login.accessToken).Password(true).
+					Validate(required),
+			))
+			if err := form.Run(); err != nil {
+				return nil, err
+			}
+		}
+		return messages.LoginToken(ctx, homeserverURL, strings.TrimSpace(login.accessToken))
+	default:
+		return nil, fmt.Errorf("unknown login method %q (want password, sso or token)", method)
+	}
+}
+
 var accountListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "list all accounts",
@@ -158,9 +340,9 @@ var accountListCmd = &cobra.Command{
 	},
 }
 
-var accountRemoveCmd = &cobra.Command{
-	Use:   "remove <name>",
-	Short: "remove an account",
+var accountLogoutCmd = &cobra.Command{
+	Use:   "logout <name>",
+	Short: "log out of the homeserver and remove the account",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		name := args[0]
@@ -171,38 +353,95 @@ var accountRemoveCmd = &cobra.Command{
 		if _, ok := cfg.Accounts[name]; !ok {
 			return fmt.Errorf("account %q not found", name)
 		}
+		if ok, err := confirmRemoveAccount(name); err != nil || !ok {
+			return err
+		}
 
-		var confirm bool
-		form := huh.NewForm(huh.NewGroup(
-			huh.NewConfirm().
-				Title(fmt.Sprintf("Remove account %q?", name)).
-				Description("This will delete the account config and credentials.").
-				Value(&confirm),
-		))
-		if err := form.Run(); err != nil {
+		p, err := messages.NewMatrixProvider(cfg.AccountDir(name))
+		if err != nil {
 			return err
 		}
-		if !confirm {
-			return nil
+		err = p.Logout(context.Background())
+		if errors.Is(err, messages.ErrReauthRequired) {
+			// Nothing left to invalidate.
+			fmt.Fprintln(os.Stderr, "The access token was already invalid.")
+		} else if err != nil {
+			return err
 		}
+		return removeAccount(cfg, name)
+	},
+}
 
-		delete(cfg.Accounts, name)
-		if cfg.Default == name {
-			cfg.Default = ""
-			for n := range cfg.Accounts {
-				cfg.Default = n
-				break
-			}
+var accountRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "remove an account, logging out of the homeserver if possible",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		cfg := config.New()
+		if err := cfg.Load(); err != nil {
+			return err
 		}
-		if err := cfg.Save(); err != nil {
+		if _, ok := cfg.Accounts[name]; !ok {
+			return fmt.Errorf("account %q not found", name)
+		}
+		if ok, err := confirmRemoveAccount(name); err != nil || !ok {
 			return err
 		}
-		os.RemoveAll(cfg.AccountDir(name))
-		fmt.Fprintf(os.Stderr, "Account %q removed.\n", name)
-		return nil
+
+		// Unlike logout, a homeserver that can't be reached doesn't stop the
+		// local files from being removed.
+		p, err := messages.NewMatrixProvider(cfg.AccountDir(name))
+		if err != nil {
+			return err
+		}
+		if err := p.Logout(context.Background()); err != nil && !errors.Is(err, messages.ErrReauthRequired) {
+			fmt.Fprintf(os.Stderr, "Warning: %v. The session stays valid until it is deleted from another client.\n", err)
+		}
+		return removeAccount(cfg, name)
 	},
 }
 
+// confirmRemoveAccount asks whether to remove the account, unless --yes was
+// given.
+func confirmRemoveAccount(name string) (bool, error) {
+	if yesFlag {
+		return true, nil
+	}
+	if !stdinIsTerminal() {
+		return false, fmt.Errorf("refusing to remove account %q without --yes when stdin is not a terminal", name)
+	}
+	var confirm bool
+	form := huh.NewForm(huh.NewGroup(
+		huh.NewConfirm().
+			Title(fmt.Sprintf("Remove account %q?", name)).
+			Description("This will delete the account config and credentials.").
+			Value(&confirm),
+	))
+	if err := form.Run(); err != nil {
+		return false, err
+	}
+	return confirm, nil
+}
+
+// removeAccount deletes the account from the config and its local files.
+func removeAccount(cfg *config.Config, name string) error {
+	delete(cfg.Accounts, name)
+	if cfg.Default == name {
+		cfg.Default = ""
+		for n := range cfg.Accounts {
+			cfg.Default = n
+			break
+		}
+	}
+	if err := cfg.Save(); err != nil {
+		return err
+	}
+	os.RemoveAll(cfg.AccountDir(name))
+	fmt.Fprintf(os.Stderr, "Account %q removed.\n", name)
+	return nil
+}
+
 var accountDefaultCmd = &cobra.Command{
 	Use:   "default <name>",
 	Short: "set the default account",
@@ -281,7 +520,7 @@ var listenCmd = &cobra.Command{
 		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer cancel()
 
-		ch, err := client.Listen(ctx)
+		ch, err := client.Listen(ctx, messages.ListenOptions{Resume: resumeFlag, Reactions: reactionsFlag})
 		if err != nil {
 			return err
 		}
@@ -290,10 +529,15 @@ var listenCmd = &cobra.Command{
 		enc := json.NewEncoder(os.Stdout)
 		for msg := range ch {
 			if err := enc.Encode(msg); err != nil {
-				fmt.Fprintf(os.Stderr, "error writing message: %v\n", err)
+				// Leave the checkpoint behind this message so a resumed
+				// listener emits it again.
+				return fmt.Errorf("error writing message: %w", err)
+			}
+			if err := client.Checkpoint(context.Background(), &msg); err != nil {
+				fmt.Fprintf(os.Stderr, "error saving checkpoint: %v\n", err)
 			}
 		}
-		return nil
+		return client.ListenErr()
 	},
 }
 
@@ -303,16 +547,21 @@ var sendCmd = &cobra.Command{
 	Use:   "send [target] [message]",
 	Short: "send a message to a room (!room_id) or user (@user:server) via args or JSON lines on stdin",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if sendOutputFlag != "text" && sendOutputFlag != "json" {
+			return fmt.Errorf("unknown output format %q (must be text or json)", sendOutputFlag)
+		}
 		client, err := messages.New(nil, accountFlag)
 		if err != nil {
 			return err
 		}
 		defer client.Close()
 		ctx := context.Background()
+		enc := json.NewEncoder(os.Stdout)
 
 		// Args mode: messages send <target> <message>
 		// target can be a room ID (!...) or a user ID (@...)
-		if len(args) >= 2 {
+		// With --file the message is an optional caption.
+		if len(args) >= 2 || (fileFlag != "" && len(args) == 1) {
 			target := args[0]
 			text := strings.Join(args[1:], " ")
 			roomID, err := resolveTarget(ctx, client, target)
@@ -320,51 +569,776 @@ var sendCmd = &cobra.Command{
 				return err
 			}
 			slog.Debug("sending message via args", "room_id", roomID, "text", text)
-			if err := client.Send(ctx, roomID, text); err != nil {
+			result, err := client.Send(ctx, roomID, &messages.OutgoingMessage{
+				Text:     text,
+				Format:   formatFlag,
+				ReplyTo:  replyToFlag,
+				ThreadID: threadIDFlag,
+				File:     fileFlag,
+			})
+			if err != nil {
 				return err
 			}
+			if sendOutputFlag == "json" {
+				return enc.Encode(sendOutput{SendResult: result})
+			}
 			fmt.Fprintln(os.Stderr, "Message sent.")
 			return nil
 		}
 
 		// Stdin mode: read JSON lines
 		slog.Debug("reading messages from stdin")
+		var outMu sync.Mutex
+		report := func(msg *messages.OutgoingMessage, result *messages.SendResult, queued bool, err error) {
+			outMu.Lock()
+			defer outMu.Unlock()
+			if sendOutputFlag == "json" {
+				if err := enc.Encode(newSendOutput(msg, result, queued, err)); err != nil {
+					slog.Warn("failed to write send result", "error", err)
+				}
+			} else if queued && err != nil {
+				fmt.Fprintf(os.Stderr, "queued for retry: %v\n", err)
+			} else if queued {
+				fmt.Fprintln(os.Stderr, "queued behind earlier unsent messages to the same room")
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping message: %v\n", err)
+			}
+		}
+		dispatcher := client.NewDispatcher(messages.DispatchOptions{
+			Concurrency: concurrencyFlag,
+			Rate:        rateFlag,
+			GlobalRate:  globalRateFlag,
+		}, func(msg *messages.OutgoingMessage, result *messages.SendResult, queued bool, err error) {
+			if err != nil {
+				err = fmt.Errorf("send error: %w", err)
+			}
+			report(msg, result, queued, err)
+		})
+		flushed := func(entry *messages.OutboxEntry, result *messages.SendResult, err error) {
+			if err != nil && sendOutputFlag != "json" {
+				fmt.Fprintf(os.Stderr, "giving up on message after %d attempts (moved to dead letters): %v\n", entry.Attempts, err)
+				return
+			}
+			report(&entry.Message, result, false, err)
+		}
+
+		// Retry the messages that failed temporarily while stdin is still
+		// being read, so that a room with a queued message isn't held up
+		// until stdin is closed. Messages left in the outbox by earlier runs
+		// are sent too.
+		flushCtx, stopFlush := context.WithCancel(ctx)
+		defer stopFlush()
+		readDone := make(chan struct{})
+		flushErr := make(chan error, 1)
+		go func() { flushErr <- flushOutbox(flushCtx, dispatcher, readDone, flushed) }()
+
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
 			line := scanner.Text()
 			if strings.TrimSpace(line) == "" {
 				continue
 			}
-			var msg messages.OutgoingMessage
-			if err := json.Unmarshal([]byte(line), &msg); err != nil {
-				fmt.Fprintf(os.Stderr, "invalid JSON line: %v\n", err)
+			msg, roomID, err := parseLine(ctx, client, line)
+			if err != nil {
+				report(msg, nil, false, err)
 				continue
 			}
-			if msg.Text == "" {
-				fmt.Fprintln(os.Stderr, "skipping message: text is required")
-				continue
+			slog.Debug("sending message via stdin", "room_id", roomID, "text", msg.Text)
+			if err := dispatcher.Submit(ctx, roomID, msg); err != nil {
+				break
 			}
-			// Resolve target: use room_id if set, otherwise resolve user_id
-			target := msg.RoomID
-			if target == "" {
-				target = msg.UserID
+		}
+		if err := dispatcher.Wait(); err != nil {
+			return err
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		// Finish sending the queued messages. If interrupted, they stay
+		// queued.
+		close(readDone)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		go func() {
+			select {
+			case <-sigs:
+				stopFlush()
+			case <-flushCtx.Done():
 			}
-			if target == "" {
-				fmt.Fprintln(os.Stderr, "skipping message: room_id or user_id is required")
-				continue
+		}()
+		err = <-flushErr
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "Interrupted; unsent messages remain in the outbox.")
+			return nil
+		}
+		return err
+	},
+}
+
+// outboxPollInterval is how often send looks for newly queued messages
+// while it is reading stdin.
+const outboxPollInterval = 5 * time.Second
+
+// flushOutbox sends the messages in the outbox through the dispatcher as
+// they come due, checking for new ones every outboxPollInterval, until
+// readDone is closed. It then sends the remaining ones and returns.
+func flushOutbox(ctx context.Context, dispatcher *messages.Dispatcher, readDone <-chan struct{}, done func(*messages.OutboxEntry, *messages.SendResult, error)) error {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := dispatcher.FlushOutbox(ctx, done); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-readDone:
+			// Messages may have been queued after the last pass.
+			return dispatcher.FlushOutbox(ctx, done)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendOutput is a line written by send --output json: the sent event, or the
+// error for the input line with the same ID. A queued message gets a second
+// line with the same TxnID once it is sent or given up on.
+type sendOutput struct {
+	ID    string `json:"id,omitempty"`
+	TxnID string `json:"txn_id,omitempty"`
+	*messages.SendResult
+	Queued bool   `json:"queued,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newSendOutput builds the output line for msg, which is nil for an input
+// line that couldn't be parsed.
+func newSendOutput(msg *messages.OutgoingMessage, result *messages.SendResult, queued bool, err error) sendOutput {
+	out := sendOutput{SendResult: result, Queued: queued}
+	if msg != nil {
+		out.ID, out.TxnID = msg.ID, msg.TxnID
+	}
+	if err != nil {
+		out.Error = err.Error()
+	}
+	return out
+}
+
+// parseLine parses a JSON line read by send and resolves its target room.
+// The parsed message is returned even when the line is invalid so the
+// caller can report its ID.
+func parseLine(ctx context.Context, client *messages.Client, line string) (*messages.OutgoingMessage, string, error) {
+	var msg messages.OutgoingMessage
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return nil, "", fmt.Errorf("invalid JSON line: %w", err)
+	}
+	if msg.Text == "" && msg.File == "" && msg.Reaction == "" && msg.Redact == "" {
+		return &msg, "", fmt.Errorf("text, file, reaction or redact is required")
+	}
+	// Resolve target: use room_id if set, otherwise resolve user_id
+	target := msg.RoomID
+	if target == "" {
+		target = msg.UserID
+	}
+	if target == "" {
+		return &msg, "", fmt.Errorf("room_id or user_id is required")
+	}
+	roomID, err := resolveTarget(ctx, client, target)
+	if err != nil {
+		return &msg, "", err
+	}
+	if msg.Format == "" {
+		msg.Format = formatFlag
+	}
+	return &msg, roomID, nil
+}
+
+// --- react command ---
+
+var reactCmd = &cobra.Command{
+	Use:   "react <target> <event-id> <emoji>",
+	Short: "react to a message in a room (!room_id) or DM (@user:server)",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		ctx := context.Background()
+
+		roomID, err := resolveTarget(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := client.Send(ctx, roomID, &messages.OutgoingMessage{
+			ReactsTo: args[1],
+			Reaction: args[2],
+		}); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Reaction sent.")
+		return nil
+	},
+}
+
+// --- edit command ---
+
+var editCmd = &cobra.Command{
+	Use:   "edit <target> <event-id> <message>",
+	Short: "replace the text of a message sent to a room (!room_id) or DM (@user:server)",
+	Args:  cobra.MinimumNArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		ctx := context.Background()
+
+		roomID, err := resolveTarget(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := client.Send(ctx, roomID, &messages.OutgoingMessage{
+			Text:     strings.Join(args[2:], " "),
+			Format:   formatFlag,
+			Replaces: args[1],
+		}); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Message edited.")
+		return nil
+	},
+}
+
+// --- redact command ---
+
+var redactCmd = &cobra.Command{
+	Use:   "redact <target> <event-id>",
+	Short: "redact (delete) an event in a room (!room_id) or DM (@user:server)",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		ctx := context.Background()
+
+		roomID, err := resolveTarget(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := client.Send(ctx, roomID, &messages.OutgoingMessage{
+			Redact: args[1],
+			Reason: reasonFlag,
+		}); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Event redacted.")
+		return nil
+	},
+}
+
+// --- history command ---
+
+var historyCmd = &cobra.Command{
+	Use:   "history <target>",
+	Short: "output past messages in a room (!room_id) or DM (@user:server) as JSON lines, oldest first",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := messages.HistoryOptions{Limit: limitFlag, Before: beforeFlag}
+		if sinceFlag != "" {
+			since, err := parseSince(sinceFlag)
+			if err != nil {
+				return err
 			}
-			roomID, err := resolveTarget(ctx, client, target)
+			opts.Since = since
+		}
+
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		ctx := context.Background()
+
+		roomID, err := resolveTarget(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+		msgs, err := client.History(ctx, roomID, opts)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, msg := range msgs {
+			if err := enc.Encode(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// --- download command ---
+
+var downloadCmd = &cobra.Command{
+	Use:   "download <mxc-url|event-id>",
+	Short: "download an attachment by mxc:// URL or by event ID (with --room), decrypting it if needed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		data, att, err := client.Download(context.Background(), roomFlag, args[0])
+		if err != nil {
+			return err
+		}
+		if destFlag == "-" {
+			_, err := os.Stdout.Write(data)
+			return err
+		}
+		// A name picked from the attachment may collide with an unrelated
+		// file, so it is only overwritten with --force; an explicit --dest is.
+		dest, overwrite := destFlag, true
+		if dest == "" {
+			dest, overwrite = downloadName(args[0], att), forceFlag
+		}
+		if err := writeDownload(dest, data, overwrite); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved %s (%d bytes).\n", dest, len(data))
+		return nil
+	},
+}
+
+// downloadName returns the file name an attachment is saved as without
+// --dest: its own file name, or else the event ID it was downloaded by with
+// an extension for its MIME type.
+func downloadName(ref string, att *messages.Attachment) string {
+	if name := filepath.Base(att.FileName); att.FileName != "" && name != "." && name != ".." && name != string(filepath.Separator) {
+		return name
+	}
+	return strings.ReplaceAll(ref, "/", "_") + exmime.ExtensionFromMimetype(att.MimeType)
+}
+
+// writeDownload writes data to a new file at dest, replacing an existing one
+// only if overwrite is set.
+func writeDownload(dest string, data []byte, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	f, err := os.OpenFile(dest, flags, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists; use --dest to save it elsewhere or --force to overwrite it", dest)
+	} else if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// --- devices commands ---
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "manage the account's logged-in sessions",
+}
+
+var devicesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the account's devices",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		devices, err := client.Devices(context.Background())
+		if err != nil {
+			return err
+		}
+
+		switch outputFlag {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			for _, d := range devices {
+				if err := enc.Encode(d); err != nil {
+					return err
+				}
+			}
+		default:
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tLAST SEEN\tIP\tCURRENT")
+			for _, d := range devices {
+				current := ""
+				if d.Current {
+					current = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, d.LastSeen, d.LastSeenIP, current)
+			}
+			w.Flush()
+		}
+		return nil
+	},
+}
+
+var devicesRenameCmd = &cobra.Command{
+	Use:   "rename <device-id> <name...>",
+	Short: "set the display name of a device",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return client.RenameDevice(context.Background(), args[0], strings.Join(args[1:], " "))
+	},
+}
+
+var devicesDeleteCmd = &cobra.Command{
+	Use:   "delete <device-id>...",
+	Short: "log out other devices of the account",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		getPassword, err := accountPassword()
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		for _, deviceID := range args {
+			if err := client.DeleteDevice(ctx, deviceID, getPassword); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Device %s deleted.\n", deviceID)
+		}
+		return nil
+	},
+}
+
+// accountPassword returns a function that gets the account password for
+// user-interactive authentication from --password-stdin, MESSAGES_PASSWORD
+// or a prompt. It asks at most once, and only if the homeserver wants it.
+func accountPassword() (func() (string, error), error) {
+	password := os.Getenv("MESSAGES_PASSWORD")
+	if passwordStdinFlag {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	return func() (string, error) {
+		if password != "" {
+			return password, nil
+		}
+		if passwordStdinFlag || !stdinIsTerminal() {
+			return "", fmt.Errorf("the homeserver asks for the account password: use --password-stdin or set MESSAGES_PASSWORD")
+		}
+		err := huh.NewInput().Title("Password").Description("Confirm with your account password.").
+			Value(&password).Password(true).Validate(required).Run()
+		return password, err
+	}, nil
+}
+
+// --- verify command ---
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [user-id]",
+	Short: "verify a device or user by comparing emoji",
+	Long: `Verify this account's device with emoji (or numbers) so other clients trust it.
+
+With a user ID, request verification: pass the account's own user ID to verify
+it from another of its sessions, or another user's ID to verify them. Without
+one, wait for a verification request from another client, such as Element's
+"Verify session".`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !stdinIsTerminal() {
+			return fmt.Errorf("verify is interactive and needs stdin to be a terminal")
+		}
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		opts := messages.VerifyOptions{
+			Accept: func(userID, deviceID string) bool {
+				accept := true
+				err := huh.NewConfirm().
+					Title(fmt.Sprintf("Accept verification request from %s (device %s)?", userID, deviceID)).
+					Value(&accept).Run()
+				return err == nil && accept
+			},
+			Confirm: func(sas messages.SAS) bool {
+				fmt.Fprintln(os.Stderr, "Compare with the other device:")
+				fmt.Fprintln(os.Stderr)
+				if len(sas.Emoji) > 0 {
+					for i, e := range sas.Emoji {
+						fmt.Fprintf(os.Stderr, "  %s  %s\n", e, sas.EmojiNames[i])
+					}
+				} else {
+					fmt.Fprintf(os.Stderr, "  %d %d %d\n", sas.Decimals[0], sas.Decimals[1], sas.Decimals[2])
+				}
+				fmt.Fprintln(os.Stderr)
+				var match bool
+				err := huh.NewConfirm().Title("Do they match?").Affirmative("They match").Negative("They don't match").
+					Value(&match).Run()
+				return err == nil && match
+			},
+		}
+		if len(args) == 1 {
+			opts.UserID = args[0]
+			fmt.Fprintf(os.Stderr, "Requesting verification from %s; accept it on the other device.\n", opts.UserID)
+		} else {
+			fmt.Fprintln(os.Stderr, "Waiting for a verification request...")
+		}
+		if err := client.Verify(ctx, opts); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Verified.")
+		return nil
+	},
+}
+
+// --- crypto commands ---
+
+var cryptoCmd = &cobra.Command{
+	Use:   "crypto",
+	Short: "set up cross-signing so other clients trust this device",
+}
+
+var cryptoBootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: "create cross-signing keys and a recovery key for the account",
+	Long: `Create cross-signing keys for the account, store them in secret storage,
+sign this device with them and start a key backup of its room keys. The
+recovery key that unlocks secret storage is printed to stdout; keep it safe,
+since 'messages crypto recover' needs it to make other devices of the account
+trusted and let them read older messages.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		getPassword, err := accountPassword()
+		if err != nil {
+			return err
+		}
+		recoveryKey, err := client.BootstrapCrossSigning(context.Background(), getPassword, replaceFlag)
+		if errors.Is(err, messages.ErrCrossSigningExists) {
+			return fmt.Errorf("%w; use 'messages crypto recover' to trust this device, or --replace to start over", err)
+		}
+		if recoveryKey != "" {
+			fmt.Println(recoveryKey)
+			fmt.Fprintln(os.Stderr, "Save this recovery key somewhere safe. It is shown only once.")
+		}
+		return err
+	},
+}
+
+var cryptoRecoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "trust this device using the account's recovery key or passphrase",
+	Long: `Unlock secret storage with the recovery key (or passphrase) from
+'messages crypto bootstrap' or another client, sign this device with the
+account's cross-signing keys and restore room keys from the key backup.
+
+The key is read from MESSAGES_RECOVERY_KEY, else from the first line of stdin
+when it isn't a terminal, else asked for.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		secret := os.Getenv("MESSAGES_RECOVERY_KEY")
+		if secret == "" && !stdinIsTerminal() {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("failed to read recovery key from stdin: %w", err)
+			}
+			secret = strings.TrimSpace(line)
+		}
+		if secret == "" {
+			if !stdinIsTerminal() {
+				return fmt.Errorf("no recovery key given: pipe it to stdin or set MESSAGES_RECOVERY_KEY")
+			}
+			err := huh.NewInput().Title("Recovery key or passphrase").
+				Value(&secret).Password(true).Validate(required).Run()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "resolve error: %v\n", err)
-				continue
+				return err
 			}
-			slog.Debug("sending message via stdin", "room_id", roomID, "text", msg.Text)
-			if err := client.Send(ctx, roomID, msg.Text); err != nil {
-				fmt.Fprintf(os.Stderr, "send error: %v\n", err)
-				continue
+		}
+
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		ctx := context.Background()
+		secret = strings.TrimSpace(secret)
+		if err := client.RecoverCrossSigning(ctx, secret); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "This device is now cross-signed.")
+		n, err := client.RestoreKeyBackup(ctx, secret)
+		if errors.Is(err, messages.ErrNoKeyBackup) {
+			fmt.Fprintln(os.Stderr, "The account has no key backup; older encrypted messages can't be restored.")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Restored %d room keys from the key backup.\n", n)
+		return nil
+	},
+}
+
+var cryptoBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "upload new room keys to the account's key backup",
+	Long: `Upload the room keys this device has that aren't in the account's key backup
+yet. 'messages listen' does this every minute by itself; run this after
+sending with 'messages send' so other devices can read what was sent.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		n, err := client.BackupRoomKeys(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Backed up %d room keys.\n", n)
+		return nil
+	},
+}
+
+// --- outbox commands ---
+
+var outboxCmd = &cobra.Command{
+	Use:   "outbox",
+	Short: "manage messages that failed to send",
+}
+
+var outboxListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list queued and dead-lettered messages",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		entries, err := client.Outbox(context.Background())
+		if err != nil {
+			return err
+		}
+
+		switch outputFlag {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range entries {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+		default:
+			if len(entries) == 0 {
+				fmt.Fprintln(os.Stderr, "Outbox is empty.")
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STATUS\tROOM\tATTEMPTS\tTEXT\tLAST ERROR")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", e.Status, e.RoomID, e.Attempts, e.Message.Text, e.LastError)
+			}
+			w.Flush()
+		}
+		return nil
+	},
+}
+
+var outboxRetryCmd = &cobra.Command{
+	Use:   "retry",
+	Short: "requeue dead-lettered messages and send everything in the outbox",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		n, err := client.RetryDeadLetters(ctx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			fmt.Fprintf(os.Stderr, "Requeued %d dead-lettered messages.\n", n)
+		}
+		var sent, failed int
+		err = client.FlushOutbox(ctx, func(entry *messages.OutboxEntry, result *messages.SendResult, err error) {
+			if err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "giving up on message after %d attempts (moved to dead letters): %v\n", entry.Attempts, err)
+				return
 			}
+			sent++
+		})
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "Interrupted; unsent messages remain in the outbox.")
+			return nil
+		} else if err != nil {
+			return err
 		}
-		return scanner.Err()
+		fmt.Fprintf(os.Stderr, "Sent %d messages, %d failed.\n", sent, failed)
+		return nil
+	},
+}
+
+var outboxPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "drop all queued and dead-lettered messages",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := messages.New(nil, accountFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		n, err := client.PurgeOutbox(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Purged %d messages.\n", n)
+		return nil
 	},
 }
 
@@ -384,19 +1358,84 @@ func resolveTarget(ctx context.Context, client *messages.Client, target string)
 	return target, nil
 }
 
+// parseSince parses a --since value, either an RFC 3339 timestamp or a
+// duration before now such as 24h.
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q: must be an RFC 3339 timestamp or a duration like 24h", s)
+	}
+	return t, nil
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&accountFlag, "account", "a", "", "account to use (default: from config)")
 	rootCmd.PersistentFlags().BoolVarP(&verboseFlag, "verbose", "v", false, "enable debug logging")
 
+	accountAddCmd.Flags().StringVar(&loginFlag, "login", "", "login method: password, sso or token (default: ask)")
+	accountAddCmd.Flags().StringVar(&homeserverFlag, "homeserver", "", "homeserver URL or server name (env MESSAGES_HOMESERVER; default: discovered from --user-id)")
+	accountAddCmd.Flags().StringVar(&userIDFlag, "user-id", "", "user ID to log in as (env MESSAGES_USER_ID)")
+	accountAddCmd.Flags().StringVar(&accessTokenFileFlag, "access-token-file", "", "file containing an access token to log in with (env MESSAGES_ACCESS_TOKEN_FILE)")
+	accountAddCmd.Flags().BoolVar(&passwordStdinFlag, "password-stdin", false, "read the password from stdin (or set MESSAGES_PASSWORD)")
+	accountRemoveCmd.Flags().BoolVarP(&yesFlag, "yes", "y", false, "remove without asking for confirmation")
+	accountLogoutCmd.Flags().BoolVarP(&yesFlag, "yes", "y", false, "log out without asking for confirmation")
+
 	listRoomsCmd.Flags().StringVarP(&outputFlag, "output", "o", "table", "output format (table, json)")
 	listCmd.AddCommand(listRoomsCmd)
 
-	accountCmd.AddCommand(accountAddCmd, accountListCmd, accountRemoveCmd, accountDefaultCmd)
-	rootCmd.AddCommand(accountCmd, listCmd, listenCmd, sendCmd)
+	devicesListCmd.Flags().StringVarP(&outputFlag, "output", "o", "table", "output format (table, json)")
+	devicesDeleteCmd.Flags().BoolVar(&passwordStdinFlag, "password-stdin", false, "read the account password from stdin (or set MESSAGES_PASSWORD)")
+	devicesCmd.AddCommand(devicesListCmd, devicesRenameCmd, devicesDeleteCmd)
+
+	cryptoBootstrapCmd.Flags().BoolVar(&passwordStdinFlag, "password-stdin", false, "read the account password from stdin (or set MESSAGES_PASSWORD)")
+	cryptoBootstrapCmd.Flags().BoolVar(&replaceFlag, "replace", false, "replace existing cross-signing keys; other sessions must be verified again")
+	cryptoCmd.AddCommand(cryptoBootstrapCmd, cryptoRecoverCmd, cryptoBackupCmd)
+
+	outboxListCmd.Flags().StringVarP(&outputFlag, "output", "o", "table", "output format (table, json)")
+	outboxCmd.AddCommand(outboxListCmd, outboxRetryCmd, outboxPurgeCmd)
+
+	listenCmd.Flags().BoolVar(&resumeFlag, "resume", false, "first emit messages received since the last checkpoint")
+	listenCmd.Flags().BoolVar(&reactionsFlag, "reactions", false, "also emit reactions as JSON lines of type \"reaction\"")
+
+	sendCmd.Flags().StringVarP(&formatFlag, "format", "f", "plain", "message format (plain, markdown, html); overridden per line by the JSON format field")
+	sendCmd.Flags().StringVar(&replyToFlag, "reply-to", "", "event ID to reply to (args mode)")
+	sendCmd.Flags().StringVar(&threadIDFlag, "thread-id", "", "thread root event ID to post in (args mode)")
+	sendCmd.Flags().StringVarP(&sendOutputFlag, "output", "o", "text", "output format (text, json); json writes one result line per message")
+	sendCmd.Flags().IntVar(&concurrencyFlag, "concurrency", 1, "number of messages to send at once; rooms are sent to in parallel, each in order")
+	sendCmd.Flags().Float64Var(&rateFlag, "rate", 0, "maximum messages per second to each room (0 for no limit)")
+	sendCmd.Flags().Float64Var(&globalRateFlag, "global-rate", 0, "maximum messages per second across all rooms (0 for no limit)")
+	sendCmd.Flags().StringVar(&fileFlag, "file", "", "file to send as an attachment, with the message as caption (args mode)")
+
+	editCmd.Flags().StringVarP(&formatFlag, "format", "f", "plain", "message format (plain, markdown, html)")
+
+	redactCmd.Flags().StringVar(&reasonFlag, "reason", "", "reason for the redaction")
+
+	historyCmd.Flags().IntVarP(&limitFlag, "limit", "n", 50, "maximum number of messages (0 for no limit)")
+	historyCmd.Flags().StringVar(&sinceFlag, "since", "", "only messages since this RFC 3339 timestamp or duration ago (e.g. 24h)")
+	historyCmd.Flags().StringVar(&beforeFlag, "before", "", "only messages before this event ID")
+
+	downloadCmd.Flags().StringVarP(&roomFlag, "room", "r", "", "room ID of the event (required when downloading by event ID)")
+	downloadCmd.Flags().StringVarP(&destFlag, "dest", "d", "", "file to write to, or - for stdout (default: attachment filename, or the event ID)")
+	downloadCmd.Flags().BoolVarP(&forceFlag, "force", "f", false, "overwrite an existing file with the default name")
+
+	accountCmd.AddCommand(accountAddCmd, accountListCmd, accountLogoutCmd, accountRemoveCmd, accountDefaultCmd)
+	rootCmd.AddCommand(accountCmd, listCmd, listenCmd, sendCmd, reactCmd, editCmd, redactCmd, historyCmd, downloadCmd, devicesCmd, verifyCmd, cryptoCmd, outboxCmd)
 }
 
+// exitReauthRequired is the exit status when the account's access token is
+// no longer valid, so supervisors can tell it apart from errors worth a
+// restart.
+const exitReauthRequired = 3
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, messages.ErrReauthRequired) {
+			fmt.Fprintln(os.Stderr, "The access token is no longer valid. Remove the account and add it again to log in.")
+			os.Exit(exitReauthRequired)
+		}
 		os.Exit(1)
 	}
 }
@@ -22,7 +22,7 @@
           pname = "messages";
           version = "0.1.0";
           src = ./.;
-          vendorHash = "sha256-1cBPDVfJNKApZwcUuIzgEc3KbgX09dNDeU1EHLFo61c=";
+          vendorHash = "sha256-ncG9fERxIiodiHdc/Q8YgCMErMgZIshAO6jNdOG+7lA=";
           subPackages = [ "cmd/messages" ];
           tags = [ "goolm" ];
 
@@ -0,0 +1,173 @@
+package messages
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// attachFile uploads the file at path to the media repository and turns
+// content into an m.file, m.image, m.video or m.audio message. A non-empty
+// content body is kept as the caption. In encrypted rooms the file is
+// encrypted before upload as described in the spec.
+func (p *MatrixProvider) attachFile(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read attachment: %w", err)
+	}
+	fileName := filepath.Base(path)
+	mimeType := detectMIMEType(fileName, data)
+
+	info := &event.FileInfo{MimeType: mimeType, Size: len(data)}
+	content.MsgType = msgTypeForMIME(mimeType)
+	if content.MsgType == event.MsgImage {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			info.Width, info.Height = cfg.Width, cfg.Height
+		}
+	}
+	content.Info = info
+	content.FileName = fileName
+	if content.Body == "" {
+		content.Body = fileName
+	}
+
+	encrypted, err := p.client.StateStore.IsEncrypted(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to check room encryption: %w", err)
+	}
+	var file *attachment.EncryptedFile
+	uploadType := mimeType
+	if encrypted {
+		file = attachment.NewEncryptedFile()
+		file.EncryptInPlace(data)
+		uploadType = "application/octet-stream"
+	}
+
+	slog.Debug("uploading attachment", "file", fileName, "mimetype", mimeType, "size", len(data), "encrypted", encrypted)
+	resp, err := p.client.UploadMedia(ctx, mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  uploadType,
+		FileName:     fileName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload attachment: %w", err)
+	}
+	if file != nil {
+		content.File = &event.EncryptedFileInfo{EncryptedFile: *file, URL: resp.ContentURI.CUString()}
+	} else {
+		content.URL = resp.ContentURI.CUString()
+	}
+	return nil
+}
+
+// detectMIMEType guesses the MIME type of a file from its extension, falling
+// back to sniffing the content.
+func detectMIMEType(fileName string, data []byte) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); mimeType != "" {
+		mediaType, _, err := mime.ParseMediaType(mimeType)
+		if err == nil {
+			return mediaType
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return mediaType
+}
+
+func msgTypeForMIME(mimeType string) event.MessageType {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// attachmentFromContent returns the attachment of a media message, or nil if
+// content has no file.
+func attachmentFromContent(content *event.MessageEventContent) *Attachment {
+	if content.URL == "" && content.File == nil {
+		return nil
+	}
+	att := &Attachment{
+		URL:      string(content.URL),
+		FileName: content.GetFileName(),
+	}
+	if content.Info != nil {
+		att.MimeType = content.Info.MimeType
+		att.Size = content.Info.Size
+		att.Width = content.Info.Width
+		att.Height = content.Info.Height
+	}
+	if content.File != nil {
+		att.URL = string(content.File.URL)
+		att.Encryption = &AttachmentEncryption{
+			Key:     content.File.Key.Key,
+			IV:      content.File.InitVector,
+			SHA256:  content.File.Hashes.SHA256,
+			Version: content.File.Version,
+		}
+	}
+	return att
+}
+
+func (p *MatrixProvider) Download(ctx context.Context, roomID string, ref string) ([]byte, *Attachment, error) {
+	var att *Attachment
+	var file *attachment.EncryptedFile
+	if strings.HasPrefix(ref, "mxc://") {
+		att = &Attachment{URL: ref, FileName: path.Base(ref)}
+	} else {
+		if roomID == "" {
+			return nil, nil, fmt.Errorf("a room ID is required to download by event ID")
+		}
+		evt, err := p.fetchEvent(ctx, id.RoomID(roomID), id.EventID(ref))
+		if err != nil {
+			return nil, nil, err
+		}
+		content := evt.Content.AsMessage()
+		if content == nil {
+			return nil, nil, fmt.Errorf("event %s is not a message", ref)
+		}
+		if att = attachmentFromContent(content); att == nil {
+			return nil, nil, fmt.Errorf("event %s has no attachment", ref)
+		}
+		if content.File != nil {
+			file = &content.File.EncryptedFile
+		}
+	}
+
+	uri, err := id.ParseContentURI(att.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid content URI %q: %w", att.URL, err)
+	}
+	slog.Debug("downloading attachment", "url", att.URL, "encrypted", file != nil)
+	data, err := p.client.DownloadBytes(ctx, uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download attachment: %w", err)
+	}
+	if file != nil {
+		if err := file.DecryptInPlace(data); err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt attachment: %w", err)
+		}
+	}
+	return data, att, nil
+}
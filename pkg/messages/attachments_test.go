@@ -0,0 +1,69 @@
+package messages
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestDetectMIMEType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"report.pdf", nil, "application/pdf"},
+		{"screenshot.png", png, "image/png"},
+		{"noext", png, "image/png"},
+		{"build", []byte("plain log output\n"), "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := detectMIMEType(tt.name, tt.data); got != tt.want {
+			t.Errorf("detectMIMEType(%q): got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMsgTypeForMIME(t *testing.T) {
+	tests := map[string]event.MessageType{
+		"image/png":       event.MsgImage,
+		"video/mp4":       event.MsgVideo,
+		"audio/ogg":       event.MsgAudio,
+		"application/pdf": event.MsgFile,
+	}
+	for mimeType, want := range tests {
+		if got := msgTypeForMIME(mimeType); got != want {
+			t.Errorf("msgTypeForMIME(%q): got %q, want %q", mimeType, got, want)
+		}
+	}
+}
+
+func TestAttachmentFromContent(t *testing.T) {
+	if att := attachmentFromContent(&event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}); att != nil {
+		t.Errorf("text message: got %+v, want nil", att)
+	}
+
+	plain := attachmentFromContent(&event.MessageEventContent{
+		MsgType:  event.MsgImage,
+		Body:     "cat.png",
+		URL:      "mxc://example.org/cat",
+		Info:     &event.FileInfo{MimeType: "image/png", Size: 1234, Width: 64, Height: 48},
+		FileName: "cat.png",
+	})
+	if plain == nil || plain.URL != "mxc://example.org/cat" || plain.FileName != "cat.png" ||
+		plain.MimeType != "image/png" || plain.Size != 1234 || plain.Width != 64 || plain.Encryption != nil {
+		t.Errorf("plain attachment: got %+v", plain)
+	}
+
+	file := &event.EncryptedFileInfo{URL: "mxc://example.org/secret"}
+	file.Key.Key = "key"
+	file.InitVector = "iv"
+	file.Hashes.SHA256 = "hash"
+	file.Version = "v2"
+	encrypted := attachmentFromContent(&event.MessageEventContent{MsgType: event.MsgFile, Body: "report.pdf", File: file})
+	if encrypted == nil || encrypted.URL != "mxc://example.org/secret" || encrypted.Encryption == nil ||
+		encrypted.Encryption.Key != "key" || encrypted.Encryption.SHA256 != "hash" {
+		t.Errorf("encrypted attachment: got %+v", encrypted)
+	}
+}
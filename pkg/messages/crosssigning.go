@@ -0,0 +1,134 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/ssss"
+)
+
+// ErrCrossSigningExists is returned by BootstrapCrossSigning when the account
+// already has cross-signing keys.
+var ErrCrossSigningExists = errors.New("cross-signing is already set up for this account")
+
+// BootstrapCrossSigning generates cross-signing keys for the account, stores
+// them in secret storage (SSSS) under a new recovery key, publishes them and
+// signs this device with them. It also starts a new key backup whose key is
+// kept in secret storage too. password is called if the homeserver asks for
+// the account password. Unless replace is set, it refuses to replace existing
+// cross-signing keys, which would make every other session of the account
+// need verifying again.
+func (p *MatrixProvider) BootstrapCrossSigning(ctx context.Context, password func() (string, error), replace bool) (string, error) {
+	mach := p.cryptoHelper.Machine()
+	if !replace {
+		existing, err := mach.GetCrossSigningPublicKeys(ctx, p.userID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check for existing cross-signing keys: %w", err)
+		}
+		if existing != nil {
+			return "", ErrCrossSigningExists
+		}
+	}
+
+	var passwordErr error
+	uia := func(resp *mautrix.RespUserInteractive) any {
+		if !resp.HasSingleStageFlow(mautrix.AuthTypePassword) {
+			passwordErr = errors.New("the homeserver doesn't allow uploading cross-signing keys with a password")
+			return nil
+		}
+		var pw string
+		if pw, passwordErr = password(); passwordErr != nil {
+			return nil
+		}
+		return passwordAuth(resp.Session, p.userID.String(), pw)
+	}
+	slog.Debug("generating cross-signing keys")
+	recoveryKey, keys, err := mach.GenerateAndUploadCrossSigningKeys(ctx, uia, "")
+	if err != nil {
+		if passwordErr != nil {
+			err = passwordErr
+		}
+		return "", fmt.Errorf("failed to set up cross-signing: %w", err)
+	}
+	if err := p.signOwnDevice(ctx); err != nil {
+		return recoveryKey, err
+	}
+
+	// Start a key backup under the same recovery key, so that new devices
+	// can read messages sent before they existed.
+	key, err := ssssKey(ctx, mach.SSSS, recoveryKey)
+	if err != nil {
+		return recoveryKey, err
+	}
+	if err := p.createKeyBackup(ctx, key, keys.MasterKey); err != nil {
+		return recoveryKey, err
+	}
+	if _, err := p.BackupRoomKeys(ctx); err != nil {
+		return recoveryKey, err
+	}
+	return recoveryKey, nil
+}
+
+// RecoverCrossSigning unlocks secret storage with a recovery key or
+// passphrase, fetches the account's cross-signing keys from it and signs this
+// device with them, so other sessions trust it without verifying it.
+func (p *MatrixProvider) RecoverCrossSigning(ctx context.Context, secret string) error {
+	mach := p.cryptoHelper.Machine()
+	key, err := ssssKey(ctx, mach.SSSS, secret)
+	if err != nil {
+		return err
+	}
+	if err := mach.FetchCrossSigningKeysFromSSSS(ctx, key); err != nil {
+		return fmt.Errorf("failed to fetch cross-signing keys from secret storage: %w", err)
+	}
+	return p.signOwnDevice(ctx)
+}
+
+// ssssKey returns the default secret storage key, given either its recovery
+// key or the passphrase it was derived from.
+func ssssKey(ctx context.Context, sm *ssss.Machine, secret string) (*ssss.Key, error) {
+	keyID, keyData, err := sm.GetDefaultKeyData(ctx)
+	if err != nil {
+		if errors.Is(err, ssss.ErrNoDefaultKeyAccountDataEvent) {
+			return nil, errors.New("the account has no secret storage; run 'messages crypto bootstrap' first")
+		}
+		return nil, fmt.Errorf("failed to get secret storage key: %w", err)
+	}
+	key, err := keyData.VerifyRecoveryKey(keyID, secret)
+	if err != nil && keyData.Passphrase != nil {
+		slog.Debug("not a valid recovery key, trying it as a passphrase")
+		key, err = keyData.VerifyPassphrase(keyID, secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wrong recovery key or passphrase: %w", err)
+	}
+	return key, nil
+}
+
+// signOwnDevice cross-signs this device and signs the master key with it, so
+// that the device and the account's identity vouch for each other.
+func (p *MatrixProvider) signOwnDevice(ctx context.Context) error {
+	mach := p.cryptoHelper.Machine()
+	if err := mach.SignOwnDevice(ctx, mach.OwnIdentity()); err != nil {
+		return fmt.Errorf("failed to sign own device: %w", err)
+	}
+	if err := mach.SignOwnMasterKey(ctx); err != nil {
+		return fmt.Errorf("failed to sign own master key: %w", err)
+	}
+	slog.Debug("device cross-signed", "device_id", p.client.DeviceID)
+	return nil
+}
+
+// passwordAuth is the auth dict for an m.login.password stage of
+// user-interactive authentication.
+func passwordAuth(session, userID, password string) map[string]any {
+	return map[string]any{
+		"type":       mautrix.AuthTypePassword,
+		"session":    session,
+		"identifier": mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: userID},
+		"password":   password,
+	}
+}
@@ -0,0 +1,60 @@
+package messages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/ssss"
+)
+
+func TestSSSSKey(t *testing.T) {
+	key, err := ssss.NewKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hasStorage bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/_matrix/client/v3/user/@bot:example.org/account_data/"
+		switch {
+		case hasStorage && r.URL.Path == prefix+"m.secret_storage.default_key":
+			json.NewEncoder(w).Encode(map[string]string{"key": key.ID})
+		case hasStorage && r.URL.Path == prefix+"m.secret_storage.key."+key.ID:
+			json.NewEncoder(w).Encode(key.Metadata)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_NOT_FOUND", "error": "Not found"})
+		}
+	}))
+	defer srv.Close()
+
+	client, err := mautrix.NewClient(srv.URL, "@bot:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := ssss.NewSSSSMachine(client)
+	ctx := context.Background()
+
+	if _, err := ssssKey(ctx, sm, key.RecoveryKey()); err == nil || !strings.Contains(err.Error(), "bootstrap") {
+		t.Errorf("without secret storage, got error %v, want a hint to bootstrap", err)
+	}
+
+	hasStorage = true
+	for _, secret := range []string{key.RecoveryKey(), "correct horse"} {
+		got, err := ssssKey(ctx, sm, secret)
+		if err != nil {
+			t.Fatalf("%q: %v", secret, err)
+		}
+		if !bytes.Equal(got.Key, key.Key) {
+			t.Errorf("%q unlocked the wrong key", secret)
+		}
+	}
+	if _, err := ssssKey(ctx, sm, "wrong"); err == nil {
+		t.Error("expected an error for a wrong passphrase")
+	}
+}
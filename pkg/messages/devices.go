@@ -0,0 +1,115 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// Logout invalidates the account's access token on the homeserver, which
+// also removes its device. Unlike most methods it works without Initialize,
+// so an account can be logged out even if its local state is broken.
+func (p *MatrixProvider) Logout(ctx context.Context) error {
+	creds, err := p.LoadCredentials()
+	if err != nil {
+		return err
+	}
+	if creds == nil || creds.AccessToken == "" {
+		return fmt.Errorf("no credentials found")
+	}
+	client, err := mautrix.NewClient(creds.HomeserverURL, id.UserID(creds.UserID), creds.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	client.Client.Transport = newTokenRefresher(client, creds, p.LoadCredentials, p.SaveCredentials)
+	slog.Debug("logging out", "user_id", creds.UserID, "device_id", creds.DeviceID)
+	if _, err := client.Logout(ctx); err != nil {
+		return fmt.Errorf("failed to log out: %w", err)
+	}
+	return nil
+}
+
+func (p *MatrixProvider) Devices(ctx context.Context) ([]Device, error) {
+	resp, err := p.client.GetDevicesInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	devices := make([]Device, 0, len(resp.Devices))
+	for _, d := range resp.Devices {
+		device := Device{
+			ID:         string(d.DeviceID),
+			Name:       d.DisplayName,
+			LastSeenIP: d.LastSeenIP,
+			Current:    d.DeviceID == p.client.DeviceID,
+		}
+		if d.LastSeenTS > 0 {
+			device.LastSeen = time.UnixMilli(d.LastSeenTS).UTC().Format(time.RFC3339)
+		}
+		devices = append(devices, device)
+	}
+	// Most recently used first.
+	slices.SortStableFunc(devices, func(a, b Device) int {
+		return strings.Compare(b.LastSeen, a.LastSeen)
+	})
+	return devices, nil
+}
+
+func (p *MatrixProvider) RenameDevice(ctx context.Context, deviceID, name string) error {
+	err := p.client.SetDeviceInfo(ctx, id.DeviceID(deviceID), &mautrix.ReqDeviceInfo{DisplayName: name})
+	if err != nil {
+		return fmt.Errorf("failed to rename device: %w", err)
+	}
+	return nil
+}
+
+// DeleteDevice deletes another device of the account. The homeserver
+// requires user-interactive authentication for this; password is called to
+// get the account password when it asks for it.
+func (p *MatrixProvider) DeleteDevice(ctx context.Context, deviceID string, password func() (string, error)) error {
+	if id.DeviceID(deviceID) == p.client.DeviceID {
+		return fmt.Errorf("%s is this account's own device; use 'messages account logout' instead", deviceID)
+	}
+	urlPath := p.client.BuildClientURL("v3", "devices", deviceID)
+	content, err := p.client.MakeFullRequest(ctx, mautrix.FullRequest{
+		Method:      http.MethodDelete,
+		URL:         urlPath,
+		RequestJSON: struct{}{},
+	})
+	if err == nil {
+		return nil
+	}
+	// A 401 without an errcode starts user-interactive authentication.
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) ||
+		(httpErr.RespError != nil && httpErr.RespError.ErrCode != "") {
+		return fmt.Errorf("failed to delete device: %w", err)
+	}
+	var uia mautrix.RespUserInteractive
+	if err := json.Unmarshal(content, &uia); err != nil {
+		return fmt.Errorf("failed to decode authentication flows: %w", err)
+	}
+	if !uia.HasSingleStageFlow(mautrix.AuthTypePassword) {
+		return fmt.Errorf("the homeserver doesn't allow deleting devices with a password; delete it from another client")
+	}
+	pw, err := password()
+	if err != nil {
+		return err
+	}
+	slog.Debug("deleting device with password authentication", "device_id", deviceID)
+	err = p.client.DeleteDevice(ctx, id.DeviceID(deviceID), &mautrix.ReqDeleteDevice{
+		Auth: passwordAuth(uia.Session, string(p.userID), pw),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete device: %w", err)
+	}
+	return nil
+}
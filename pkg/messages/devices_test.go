@@ -0,0 +1,72 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestDeleteDevice_PasswordAuth(t *testing.T) {
+	var deleted bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/_matrix/client/v3/devices/OTHER" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Auth struct {
+				Type       string `json:"type"`
+				Session    string `json:"session"`
+				Password   string `json:"password"`
+				Identifier struct {
+					User string `json:"user"`
+				} `json:"identifier"`
+			} `json:"auth"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Auth.Type == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]any{
+				"session": "s1",
+				"flows":   []map[string]any{{"stages": []string{"m.login.password"}}},
+			})
+			return
+		}
+		if req.Auth.Session != "s1" || req.Auth.Password != "hunter2" || req.Auth.Identifier.User != "@bot:example.org" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "Invalid password"})
+			return
+		}
+		deleted = true
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	client, err := mautrix.NewClient(srv.URL, "@bot:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DeviceID = "CURRENT"
+	p := &MatrixProvider{client: client, userID: "@bot:example.org"}
+	ctx := context.Background()
+
+	var asked int
+	err = p.DeleteDevice(ctx, "OTHER", func() (string, error) {
+		asked++
+		return "hunter2", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || asked != 1 {
+		t.Errorf("deleted=%v after asking for the password %d times, want deleted after 1", deleted, asked)
+	}
+
+	if err := p.DeleteDevice(ctx, "CURRENT", nil); err == nil {
+		t.Error("expected an error deleting the current device")
+	}
+}
@@ -0,0 +1,310 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Bounds of the adaptive slowdown after the homeserver rate limits a send:
+// the interval between sends starts at minBackoffInterval and doubles up to
+// maxBackoffInterval, then shrinks by a tenth per successful send until it is
+// below speedUpThreshold.
+const (
+	minBackoffInterval = 100 * time.Millisecond
+	maxBackoffInterval = 10 * time.Second
+	speedUpThreshold   = 10 * time.Millisecond
+)
+
+// limiter spaces events out to at most one per interval. When the homeserver
+// rate limits us it pauses and doubles the interval, then speeds back up
+// towards the configured interval as sends succeed.
+type limiter struct {
+	mu       sync.Mutex
+	base     time.Duration // configured interval, 0 for no limit
+	interval time.Duration // current interval
+	next     time.Time     // earliest time of the next event
+}
+
+func newLimiter(rate float64) *limiter {
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	return &limiter{base: interval, interval: interval}
+}
+
+// Wait blocks until the caller may go ahead, reserving its slot. If ctx is
+// cancelled first, the slot is given back unless a later one was reserved.
+func (l *limiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	reserved := l.next
+	l.mu.Unlock()
+
+	wait := time.Until(at)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		if l.next.Equal(reserved) {
+			l.next = at
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// SlowDown pauses for retryAfter and halves the rate.
+func (l *limiter) SlowDown(retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = min(max(l.interval*2, minBackoffInterval), maxBackoffInterval)
+	if resume := time.Now().Add(retryAfter); l.next.Before(resume) {
+		l.next = resume
+	}
+	slog.Debug("rate limited, slowing down", "retry_after", retryAfter, "interval", l.interval)
+}
+
+// SpeedUp moves the interval a step back towards the configured one.
+func (l *limiter) SpeedUp() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.interval <= l.base {
+		return
+	}
+	l.interval = l.interval * 9 / 10
+	if l.interval < l.base || l.interval < speedUpThreshold {
+		l.interval = l.base
+	}
+}
+
+// maxDispatchQueue is the number of submitted messages a Dispatcher holds
+// before Submit blocks.
+const maxDispatchQueue = 1000
+
+// DispatchOptions controls how a Dispatcher sends messages. Rate and
+// GlobalRate are in messages per second, per room and across all rooms; zero
+// means no limit. Concurrency is the number of sends in flight at once.
+type DispatchOptions struct {
+	Concurrency int
+	Rate        float64
+	GlobalRate  float64
+}
+
+// Dispatcher sends messages like SendOrQueue, in parallel across rooms while
+// keeping the order of messages within each room. Sends are spaced out to
+// the configured rates, and the dispatcher slows down for all rooms when the
+// homeserver rate limits it.
+type Dispatcher struct {
+	client *Client
+	opts   DispatchOptions
+	global *limiter
+	sem    chan struct{}
+	queue  chan struct{} // a slot per submitted message not yet handled
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	rooms map[string]*roomQueue
+	// stopErr is ErrReauthRequired once a send failed with it; no later
+	// send could succeed, so the dispatcher stops sending.
+	stopErr error
+
+	doneMu sync.Mutex
+	done   func(msg *OutgoingMessage, result *SendResult, queued bool, err error)
+}
+
+// roomQueue holds the messages waiting to be sent to a room. At most one
+// goroutine sends a room's messages at a time.
+type roomQueue struct {
+	limiter *limiter
+	pending []*OutgoingMessage
+	running bool
+}
+
+// NewDispatcher returns a Dispatcher that reports the outcome of each
+// message to done. done is never called concurrently.
+func (c *Client) NewDispatcher(opts DispatchOptions, done func(msg *OutgoingMessage, result *SendResult, queued bool, err error)) *Dispatcher {
+	d := &Dispatcher{
+		client: c,
+		opts:   opts,
+		global: newLimiter(opts.GlobalRate),
+		rooms:  make(map[string]*roomQueue),
+		done:   done,
+	}
+	if opts.Concurrency > 1 {
+		d.sem = make(chan struct{}, opts.Concurrency)
+		d.queue = make(chan struct{}, maxDispatchQueue)
+	}
+	return d
+}
+
+// Submit queues msg for sending to roomID. Without concurrency it sends msg
+// before returning; otherwise it blocks while maxDispatchQueue messages are
+// waiting. Once the dispatcher has stopped because the account has to log in
+// again, Submit returns that error instead.
+func (d *Dispatcher) Submit(ctx context.Context, roomID string, msg *OutgoingMessage) error {
+	if err := d.stopped(); err != nil {
+		return err
+	}
+	if d.sem == nil {
+		d.mu.Lock()
+		q := d.room(roomID)
+		d.mu.Unlock()
+		d.send(ctx, roomID, q, msg)
+		return nil
+	}
+	select {
+	case d.queue <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	d.mu.Lock()
+	q := d.room(roomID)
+	q.pending = append(q.pending, msg)
+	if !q.running {
+		q.running = true
+		d.wg.Add(1)
+		go d.run(ctx, roomID, q)
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// room returns the queue of roomID, creating it if needed. It must be called
+// with mu held.
+func (d *Dispatcher) room(roomID string) *roomQueue {
+	q := d.rooms[roomID]
+	if q == nil {
+		q = &roomQueue{limiter: newLimiter(d.opts.Rate)}
+		d.rooms[roomID] = q
+	}
+	return q
+}
+
+// stopped returns ErrReauthRequired once a send failed with it.
+func (d *Dispatcher) stopped() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopErr
+}
+
+// Wait blocks until all submitted messages have been handled. It returns
+// ErrReauthRequired if that stopped the dispatcher.
+func (d *Dispatcher) Wait() error {
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopErr
+}
+
+func (d *Dispatcher) run(ctx context.Context, roomID string, q *roomQueue) {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			d.mu.Unlock()
+			return
+		}
+		msg := q.pending[0]
+		q.pending = q.pending[1:]
+		d.mu.Unlock()
+		d.send(ctx, roomID, q, msg)
+		<-d.queue
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, roomID string, q *roomQueue, msg *OutgoingMessage) {
+	result, queued, err := d.trySend(ctx, roomID, q, msg)
+	d.doneMu.Lock()
+	defer d.doneMu.Unlock()
+	d.done(msg, result, queued, err)
+}
+
+func (d *Dispatcher) trySend(ctx context.Context, roomID string, q *roomQueue, msg *OutgoingMessage) (*SendResult, bool, error) {
+	if err := d.stopped(); err != nil {
+		return nil, false, err
+	}
+	release, err := d.acquire(ctx, q)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+	result, queued, err := d.client.SendOrQueue(ctx, roomID, msg)
+	d.adapt(err)
+	return result, queued, err
+}
+
+// acquire takes a concurrency slot, then waits for the room's and the global
+// limiter, so that no rate limit slot is held while waiting for a send to
+// finish. The returned function gives the concurrency slot back.
+func (d *Dispatcher) acquire(ctx context.Context, q *roomQueue) (func(), error) {
+	release := func() {}
+	if d.sem != nil {
+		select {
+		case d.sem <- struct{}{}:
+			release = func() { <-d.sem }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err := q.limiter.Wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	if err := d.global.Wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// adapt slows down or speeds up after a send, and stops the dispatcher if
+// the account has to log in again.
+func (d *Dispatcher) adapt(err error) {
+	if errors.Is(err, ErrReauthRequired) {
+		d.mu.Lock()
+		if d.stopErr == nil {
+			d.stopErr = err
+		}
+		d.mu.Unlock()
+	}
+	var temp *TemporaryError
+	if errors.As(err, &temp) && temp.RateLimited {
+		d.global.SlowDown(temp.RetryAfter)
+	} else if err == nil {
+		d.global.SpeedUp()
+	}
+}
+
+// FlushOutbox sends the messages in the outbox like Client.FlushOutbox, but
+// subject to the dispatcher's rates and concurrency.
+func (d *Dispatcher) FlushOutbox(ctx context.Context, done func(entry *OutboxEntry, result *SendResult, err error)) error {
+	return d.client.flushOutbox(ctx, func(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error) {
+		d.mu.Lock()
+		q := d.room(roomID)
+		d.mu.Unlock()
+		release, err := d.acquire(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		result, err := d.client.Send(ctx, roomID, msg)
+		d.adapt(err)
+		return result, err
+	}, done)
+}
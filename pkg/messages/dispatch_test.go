@@ -0,0 +1,139 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatcher_KeepsRoomOrder(t *testing.T) {
+	p := &fakeProvider{}
+	c := newTestClient(t, p)
+	ctx := context.Background()
+
+	var done []string
+	d := c.NewDispatcher(DispatchOptions{Concurrency: 4}, func(msg *OutgoingMessage, result *SendResult, queued bool, err error) {
+		if err != nil {
+			t.Errorf("message %q failed: %v", msg.Text, err)
+		}
+		done = append(done, msg.Text)
+	})
+	for i := range 5 {
+		for _, room := range []string{"a", "b", "c"} {
+			d.Submit(ctx, "!"+room+":example.org", &OutgoingMessage{Text: room + string(rune('0'+i))})
+		}
+	}
+	if err := d.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(done) != 15 {
+		t.Fatalf("reported %d messages, want 15", len(done))
+	}
+	last := map[byte]string{}
+	for _, text := range p.sent {
+		if prev := last[text[0]]; prev != "" && strings.Compare(prev, text) > 0 {
+			t.Errorf("sent %q after %q, want room order kept", text, prev)
+		}
+		last[text[0]] = text
+	}
+}
+
+func TestDispatcher_StopsOnReauth(t *testing.T) {
+	p := &fakeProvider{failures: 100, err: ErrReauthRequired}
+	c := newTestClient(t, p)
+	ctx := context.Background()
+
+	d := c.NewDispatcher(DispatchOptions{}, func(*OutgoingMessage, *SendResult, bool, error) {})
+	if err := d.Submit(ctx, "!a:example.org", &OutgoingMessage{Text: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Submit(ctx, "!b:example.org", &OutgoingMessage{Text: "second"}); !errors.Is(err, ErrReauthRequired) {
+		t.Errorf("Submit after re-auth failure: got %v, want ErrReauthRequired", err)
+	}
+	if err := d.Wait(); !errors.Is(err, ErrReauthRequired) {
+		t.Errorf("Wait: got %v, want ErrReauthRequired", err)
+	}
+	if len(p.txnIDs) != 1 {
+		t.Errorf("made %d send attempts, want 1", len(p.txnIDs))
+	}
+}
+
+func TestLimiter_SlowDownAndSpeedUp(t *testing.T) {
+	l := newLimiter(0)
+	l.SlowDown(0)
+	if l.interval != minBackoffInterval {
+		t.Fatalf("interval = %v after rate limit, want %v", l.interval, minBackoffInterval)
+	}
+	for range 100 {
+		l.SlowDown(0)
+	}
+	if l.interval != maxBackoffInterval {
+		t.Fatalf("interval = %v after repeated rate limits, want %v", l.interval, maxBackoffInterval)
+	}
+	for range 100 {
+		l.SpeedUp()
+	}
+	if l.interval != 0 {
+		t.Errorf("interval = %v after successful sends, want back to 0", l.interval)
+	}
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	l := newLimiter(20) // one per 50ms
+	ctx := context.Background()
+	start := time.Now()
+	for range 3 {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("three events took %v, want at least 100ms at 20/s", elapsed)
+	}
+}
+
+func TestLimiter_WaitCancelled(t *testing.T) {
+	l := newLimiter(1) // one per second
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	next := l.next
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to pass", err)
+	}
+	if !l.next.Equal(next) {
+		t.Errorf("next = %v after a cancelled wait, want the slot given back (%v)", l.next, next)
+	}
+}
+
+func TestDispatcher_FlushOutboxUsesLimiters(t *testing.T) {
+	p := &fakeProvider{}
+	c := newTestClient(t, p)
+	ctx := context.Background()
+
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, room := range []string{"a", "b", "c"} {
+		if err := ob.Enqueue(ctx, "!"+room+":example.org", &OutgoingMessage{Text: room}, 1, "", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := c.NewDispatcher(DispatchOptions{GlobalRate: 20}, func(*OutgoingMessage, *SendResult, bool, error) {})
+	start := time.Now()
+	if err := d.FlushOutbox(ctx, func(*OutboxEntry, *SendResult, error) {}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("flushing three messages took %v, want at least 100ms at 20/s", elapsed)
+	}
+	if len(p.sent) != 3 {
+		t.Errorf("sent %v, want all three", p.sent)
+	}
+}
@@ -0,0 +1,61 @@
+package messages
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// redact removes the content of an event, optionally giving a reason.
+func (p *MatrixProvider) redact(ctx context.Context, roomID id.RoomID, target id.EventID, reason, txnID string) (*SendResult, error) {
+	slog.Debug("redacting event", "room_id", roomID, "event_id", target)
+	resp, err := p.client.RedactEvent(ctx, roomID, target, mautrix.ReqRedact{Reason: reason, TxnID: txnID})
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("event redacted successfully", "room_id", roomID, "event_id", target)
+	return newSendResult(roomID, resp), nil
+}
+
+// applyEdit turns msg into an edit of the event it replaces: the Text, MsgType
+// and formatting of the edit are taken from m.new_content rather than the
+// "* " prefixed fallback.
+func applyEdit(msg *IncomingMessage, content *event.MessageEventContent) {
+	msg.Type = TypeEdit
+	msg.Replaces = string(content.RelatesTo.GetReplaceID())
+	newContent := content.NewContent
+	if newContent == nil {
+		return
+	}
+	msg.Text = newContent.Body
+	msg.MsgType = string(newContent.MsgType)
+	msg.Format = string(newContent.Format)
+	msg.FormattedBody = newContent.FormattedBody
+	msg.Attachment = attachmentFromContent(newContent)
+}
+
+// toIncomingRedaction converts an m.room.redaction event to an
+// IncomingMessage of type TypeRedaction.
+func (p *MatrixProvider) toIncomingRedaction(ctx context.Context, evt *event.Event) *IncomingMessage {
+	content := evt.Content.AsRedaction()
+	redacts := content.Redacts
+	if redacts == "" {
+		// Room versions before v11 only have it at the top level.
+		redacts = evt.Redacts
+	}
+	return &IncomingMessage{
+		Type:       TypeRedaction,
+		RoomID:     string(evt.RoomID),
+		RoomName:   p.getRoomDisplayName(ctx, evt.RoomID),
+		Sender:     string(evt.Sender),
+		SenderName: p.getSenderName(ctx, evt.RoomID, evt.Sender),
+		Redacts:    string(redacts),
+		Reason:     content.Reason,
+		Timestamp:  time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
+		EventID:    string(evt.ID),
+	}
+}
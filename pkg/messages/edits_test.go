@@ -0,0 +1,62 @@
+package messages
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestApplyEdit(t *testing.T) {
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          "* deploy done",
+		Format:        event.FormatHTML,
+		FormattedBody: "* deploy <b>done</b>",
+	}
+	content.NewContent = &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          "deploy done",
+		Format:        event.FormatHTML,
+		FormattedBody: "deploy <b>done</b>",
+	}
+	content.RelatesTo = (&event.RelatesTo{}).SetReplace("$orig")
+
+	msg := &IncomingMessage{Type: TypeMessage, Text: content.Body}
+	applyEdit(msg, content)
+	if msg.Type != TypeEdit || msg.Replaces != "$orig" {
+		t.Errorf("got type %q replaces %q, want edit of $orig", msg.Type, msg.Replaces)
+	}
+	if msg.Text != "deploy done" || msg.FormattedBody != "deploy <b>done</b>" {
+		t.Errorf("got %q / %q, want the new content without fallback", msg.Text, msg.FormattedBody)
+	}
+}
+
+func TestApplyEdit_WithoutNewContent(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "* fixed"}
+	content.RelatesTo = (&event.RelatesTo{}).SetReplace("$orig")
+
+	msg := &IncomingMessage{Type: TypeMessage, Text: content.Body}
+	applyEdit(msg, content)
+	if msg.Type != TypeEdit || msg.Text != "* fixed" {
+		t.Errorf("got %q %q, want edit keeping the fallback text", msg.Type, msg.Text)
+	}
+}
+
+func TestToListenMessage_Redaction(t *testing.T) {
+	p := newTestNameProvider(t, http.NotFound)
+	ctx := context.Background()
+	evt := &event.Event{
+		Type:    event.EventRedaction,
+		ID:      "$redaction",
+		RoomID:  "!room:example.org",
+		Sender:  "@alice:example.org",
+		Content: event.Content{Parsed: &event.RedactionEventContent{Redacts: "$orig"}},
+	}
+
+	msg := p.toListenMessage(ctx, evt, ListenOptions{})
+	if msg == nil || msg.Type != TypeRedaction || msg.Redacts != "$orig" {
+		t.Errorf("got %+v, want a redaction of $orig", msg)
+	}
+}
@@ -0,0 +1,73 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// historyPageSize is the number of events requested per /messages call.
+const historyPageSize = 100
+
+func (p *MatrixProvider) History(ctx context.Context, roomID string, opts HistoryOptions) ([]IncomingMessage, error) {
+	// Catching up delivers pending room keys, so recent encrypted events can
+	// be decrypted.
+	if err := p.catchUp(ctx); err != nil {
+		return nil, err
+	}
+
+	room := id.RoomID(roomID)
+	var from string
+	if opts.Before != "" {
+		resp, err := p.client.Context(ctx, room, id.EventID(opts.Before), nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get context of event %s: %w", opts.Before, err)
+		}
+		from = resp.Start
+	}
+
+	filter := &mautrix.FilterPart{Types: []event.Type{event.EventMessage, event.EventEncrypted}}
+	var msgs []IncomingMessage
+	for {
+		slog.Debug("fetching history page", "room_id", roomID, "from", from)
+		resp, err := p.client.Messages(ctx, room, from, "", mautrix.DirectionBackward, filter, historyPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		for _, evt := range resp.Chunk {
+			if !opts.Since.IsZero() && time.UnixMilli(evt.Timestamp).Before(opts.Since) {
+				return reversed(msgs), nil
+			}
+			prepared, err := p.prepareEvent(ctx, room, evt)
+			if err != nil {
+				slog.Debug("skipping history event", "event_id", evt.ID, "error", err)
+				continue
+			}
+			msg := p.toIncomingMessage(ctx, prepared)
+			if msg == nil {
+				continue
+			}
+			msgs = append(msgs, *msg)
+			if opts.Limit > 0 && len(msgs) >= opts.Limit {
+				return reversed(msgs), nil
+			}
+		}
+		if resp.End == "" || len(resp.Chunk) == 0 {
+			return reversed(msgs), nil
+		}
+		from = resp.End
+	}
+}
+
+// reversed puts messages collected while paging backwards into
+// chronological order.
+func reversed(msgs []IncomingMessage) []IncomingMessage {
+	slices.Reverse(msgs)
+	return msgs
+}
@@ -0,0 +1,110 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyEpoch is the origin_server_ts of $e0 in the fake room; $eN was sent
+// N minutes later.
+var historyEpoch = time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)
+
+// newTestHistoryProvider serves a room whose /messages pages hold, newest
+// first, $e5 $e4, then $e3 $e2, then $e1. The context of $e6 starts just
+// before $e5. It returns the provider and the from tokens of the /messages
+// requests made.
+func newTestHistoryProvider(t *testing.T) (*MatrixProvider, *[]string) {
+	t.Helper()
+	pages := map[string]struct {
+		events []int
+		end    string
+	}{
+		"t5": {[]int{5, 4}, "t3"},
+		"t3": {[]int{3, 2}, "t1"},
+		"t1": {[]int{1}, ""},
+	}
+	var froms []string
+	p := newTestNameProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/context/$e6"):
+			json.NewEncoder(w).Encode(map[string]any{"start": "t5", "end": "t7"})
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			from := r.URL.Query().Get("from")
+			froms = append(froms, from)
+			page := pages[from]
+			chunk := []map[string]any{}
+			for _, n := range page.events {
+				chunk = append(chunk, map[string]any{
+					"type":             "m.room.message",
+					"event_id":         fmt.Sprintf("$e%d", n),
+					"sender":           "@alice:example.org",
+					"origin_server_ts": historyEpoch.Add(time.Duration(n) * time.Minute).UnixMilli(),
+					"content":          map[string]string{"msgtype": "m.text", "body": fmt.Sprintf("message %d", n)},
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"start": from, "end": page.end, "chunk": chunk})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_NOT_FOUND", "error": "Not found"})
+		}
+	})
+	// A fresh sync token skips the catch-up sync.
+	if err := p.syncStore.SaveNextBatch(context.Background(), p.userID, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	return p, &froms
+}
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      HistoryOptions
+		want      []string
+		wantFroms []string
+	}{{
+		name:      "all pages before an event",
+		opts:      HistoryOptions{Before: "$e6"},
+		want:      []string{"$e1", "$e2", "$e3", "$e4", "$e5"},
+		wantFroms: []string{"t5", "t3", "t1"},
+	}, {
+		name:      "since cutoff",
+		opts:      HistoryOptions{Before: "$e6", Since: historyEpoch.Add(3 * time.Minute)},
+		want:      []string{"$e3", "$e4", "$e5"},
+		wantFroms: []string{"t5", "t3"},
+	}, {
+		name:      "limit",
+		opts:      HistoryOptions{Before: "$e6", Limit: 3},
+		want:      []string{"$e3", "$e4", "$e5"},
+		wantFroms: []string{"t5", "t3"},
+	}, {
+		name:      "limit before since",
+		opts:      HistoryOptions{Before: "$e6", Limit: 1, Since: historyEpoch},
+		want:      []string{"$e5"},
+		wantFroms: []string{"t5"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, froms := newTestHistoryProvider(t)
+			msgs, err := p.History(context.Background(), "!room:example.org", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, msg := range msgs {
+				got = append(got, msg.EventID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v in chronological order", got, tt.want)
+			}
+			if !slices.Equal(*froms, tt.wantFroms) {
+				t.Errorf("fetched pages from %v, want %v", *froms, tt.wantFroms)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package messages
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrNoKeyBackup is returned by RestoreKeyBackup when the account has no
+// online key backup.
+var ErrNoKeyBackup = errors.New("the account has no key backup")
+
+// backupInterval is how often Listen uploads new room keys to the key backup.
+const backupInterval = time.Minute
+
+// backupBatchSize is the number of room keys uploaded per request.
+const backupBatchSize = 100
+
+// maxBackupLookups is the number of sessions missing from the key backup that
+// Listen remembers so as not to look them up again. Beyond it, the sessions
+// are forgotten and may be looked up once more.
+const maxBackupLookups = 1000
+
+// keyBackup is the account's online key backup (m.megolm_backup.v1), once
+// this device has its private key.
+type keyBackup struct {
+	key     *backup.MegolmBackupKey
+	version id.KeyBackupVersion
+}
+
+// loadKeyBackup returns the key backup this device can read and write, or nil
+// if it has no backup key. The key is kept in the crypto store; the backup
+// version is checked against the homeserver's latest one.
+func (p *MatrixProvider) loadKeyBackup(ctx context.Context) (*keyBackup, error) {
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+	if p.keyBackup != nil {
+		return p.keyBackup, nil
+	}
+	mach := p.cryptoHelper.Machine()
+	secret, err := mach.CryptoStore.GetSecret(ctx, id.SecretMegolmBackupV1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key backup key: %w", err)
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key backup key: %w", err)
+	}
+	key, err := backup.MegolmBackupKeyFromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key backup key: %w", err)
+	}
+	info, err := mach.GetAndVerifyLatestKeyBackupVersion(ctx, key)
+	if err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get key backup version (run 'messages crypto recover' if it was replaced): %w", err)
+	}
+	p.keyBackup = &keyBackup{key: key, version: info.Version}
+	return p.keyBackup, nil
+}
+
+// saveKeyBackupKey stores the backup key in the crypto store, replacing the
+// cached backup.
+func (p *MatrixProvider) saveKeyBackupKey(ctx context.Context, key *backup.MegolmBackupKey) error {
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+	p.keyBackup = nil
+	secret := base64.RawStdEncoding.EncodeToString(key.Bytes())
+	if err := p.cryptoHelper.Machine().CryptoStore.PutSecret(ctx, id.SecretMegolmBackupV1, secret); err != nil {
+		return fmt.Errorf("failed to save key backup key: %w", err)
+	}
+	return nil
+}
+
+// createKeyBackup starts a new key backup version, signed with the master
+// key, and stores its key in secret storage and locally.
+func (p *MatrixProvider) createKeyBackup(ctx context.Context, ssssKey *ssss.Key, masterKey olm.PKSigning) error {
+	key, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate key backup key: %w", err)
+	}
+	authData := backup.MegolmAuthData{
+		PublicKey: id.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes())),
+	}
+	sig, err := masterKey.SignJSON(authData)
+	if err != nil {
+		return fmt.Errorf("failed to sign key backup: %w", err)
+	}
+	authData.Signatures = signatures.NewSingleSignature(p.userID, id.KeyAlgorithmEd25519, masterKey.PublicKey().String(), sig)
+	resp, err := p.client.CreateKeyBackupVersion(ctx, &mautrix.ReqRoomKeysVersionCreate[backup.MegolmAuthData]{
+		Algorithm: id.KeyBackupAlgorithmMegolmBackupV1,
+		AuthData:  authData,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create key backup: %w", err)
+	}
+	slog.Debug("created key backup", "version", resp.Version)
+	mach := p.cryptoHelper.Machine()
+	if err := mach.SSSS.SetEncryptedAccountData(ctx, event.AccountDataMegolmBackupKey, key.Bytes(), ssssKey); err != nil {
+		return fmt.Errorf("failed to store key backup key in secret storage: %w", err)
+	}
+	return p.saveKeyBackupKey(ctx, key)
+}
+
+// RestoreKeyBackup unlocks secret storage with a recovery key or passphrase,
+// takes the key backup key from it and imports every room key in the backup,
+// so messages sent before this device existed can be decrypted. It returns
+// the number of keys imported.
+func (p *MatrixProvider) RestoreKeyBackup(ctx context.Context, secret string) (int, error) {
+	mach := p.cryptoHelper.Machine()
+	sKey, err := ssssKey(ctx, mach.SSSS, secret)
+	if err != nil {
+		return 0, err
+	}
+	raw, err := mach.SSSS.GetDecryptedAccountData(ctx, event.AccountDataMegolmBackupKey, sKey)
+	if err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return 0, ErrNoKeyBackup
+		}
+		return 0, fmt.Errorf("failed to get key backup key from secret storage: %w", err)
+	}
+	key, err := backup.MegolmBackupKeyFromBytes(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode key backup key: %w", err)
+	}
+	if err := p.saveKeyBackupKey(ctx, key); err != nil {
+		return 0, err
+	}
+	kb, err := p.loadKeyBackup(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if kb == nil {
+		return 0, ErrNoKeyBackup
+	}
+
+	slog.Debug("downloading key backup", "version", kb.version)
+	keys, err := p.client.GetKeyBackup(ctx, kb.version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download key backup: %w", err)
+	}
+	store := mach.CryptoStore
+	var count int
+	for roomID, room := range keys.Rooms {
+		for sessionID, data := range room.Sessions {
+			// Keep a key we already have unless the backup's goes further back.
+			have, _ := store.GetGroupSession(ctx, roomID, sessionID)
+			if have != nil && have.Internal.FirstKnownIndex() <= uint32(data.FirstMessageIndex) {
+				continue
+			}
+			if err := p.importBackedUpKey(ctx, kb, roomID, sessionID, &data); err != nil {
+				slog.Warn("failed to import room key from backup", "room_id", roomID, "session_id", sessionID, "error", err)
+				continue
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (p *MatrixProvider) importBackedUpKey(ctx context.Context, kb *keyBackup, roomID id.RoomID, sessionID id.SessionID, data *mautrix.RespKeyBackupData[backup.EncryptedSessionData[backup.MegolmSessionData]]) error {
+	session, err := data.SessionData.Decrypt(kb.key)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt room key: %w", err)
+	}
+	_, err = p.cryptoHelper.Machine().ImportRoomKeyFromBackup(ctx, kb.version, roomID, sessionID, session)
+	return err
+}
+
+// BackupRoomKeys uploads the room keys that aren't in the key backup yet and
+// returns how many were uploaded. It does nothing without a backup key.
+func (p *MatrixProvider) BackupRoomKeys(ctx context.Context) (int, error) {
+	kb, err := p.loadKeyBackup(ctx)
+	if err != nil || kb == nil {
+		return 0, err
+	}
+	store := p.cryptoHelper.Machine().CryptoStore
+	sessions, err := store.GetGroupSessionsWithoutKeyBackupVersion(ctx, kb.version).AsList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list room keys: %w", err)
+	}
+	var count int
+	for len(sessions) > 0 {
+		batch := sessions[:min(backupBatchSize, len(sessions))]
+		sessions = sessions[len(batch):]
+		req := &mautrix.ReqKeyBackup{Rooms: make(map[id.RoomID]mautrix.ReqRoomKeyBackup)}
+		var added []*crypto.InboundGroupSession
+		for _, session := range batch {
+			data, err := backupSessionData(kb, session)
+			if err != nil {
+				slog.Warn("failed to back up room key", "session_id", session.ID(), "error", err)
+				continue
+			}
+			room, ok := req.Rooms[session.RoomID]
+			if !ok {
+				room = mautrix.ReqRoomKeyBackup{Sessions: make(map[id.SessionID]mautrix.ReqKeyBackupData)}
+				req.Rooms[session.RoomID] = room
+			}
+			room.Sessions[session.ID()] = *data
+			added = append(added, session)
+		}
+		if len(added) == 0 {
+			continue
+		}
+		slog.Debug("uploading room keys to backup", "version", kb.version, "count", len(added))
+		if _, err := p.client.PutKeysInBackup(ctx, kb.version, req); err != nil {
+			if errors.Is(err, mautrix.MWrongRoomKeysVersion) {
+				p.backupMu.Lock()
+				p.keyBackup = nil
+				p.backupMu.Unlock()
+			}
+			return count, fmt.Errorf("failed to upload room keys to backup: %w", err)
+		}
+		// Keys that couldn't be encrypted are left unmarked and tried again
+		// by the next backup.
+		for _, session := range added {
+			session.KeyBackupVersion = kb.version
+			if err := store.PutGroupSession(ctx, session); err != nil {
+				return count, fmt.Errorf("failed to mark room key as backed up: %w", err)
+			}
+		}
+		count += len(added)
+	}
+	return count, nil
+}
+
+// backupSessionData encrypts a room key for the key backup.
+func backupSessionData(kb *keyBackup, session *crypto.InboundGroupSession) (*mautrix.ReqKeyBackupData, error) {
+	firstIndex := session.Internal.FirstKnownIndex()
+	sessionKey, err := session.Internal.Export(firstIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export room key: %w", err)
+	}
+	encrypted, err := backup.EncryptSessionData(kb.key, backup.MegolmSessionData{
+		Algorithm:          id.AlgorithmMegolmV1,
+		ForwardingKeyChain: session.ForwardingChains,
+		SenderClaimedKeys:  backup.SenderClaimedKeys{Ed25519: session.SigningKey},
+		SenderKey:          session.SenderKey,
+		SessionKey:         string(sessionKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt room key: %w", err)
+	}
+	sessionData, err := json.Marshal(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.ReqKeyBackupData{
+		FirstMessageIndex: int(firstIndex),
+		ForwardedCount:    len(session.ForwardingChains),
+		SessionData:       sessionData,
+	}, nil
+}
+
+// restoreRoomKey fetches a single missing room key from the key backup. It
+// returns whether the key was found.
+func (p *MatrixProvider) restoreRoomKey(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) (bool, error) {
+	kb, err := p.loadKeyBackup(ctx)
+	if err != nil || kb == nil {
+		return false, err
+	}
+	data, err := p.client.GetKeyBackupForRoomAndSession(ctx, kb.version, roomID, sessionID)
+	if err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to fetch room key from backup: %w", err)
+	}
+	if err := p.importBackedUpKey(ctx, kb, roomID, sessionID, data); err != nil {
+		return false, err
+	}
+	slog.Debug("restored room key from backup", "room_id", roomID, "session_id", sessionID)
+	return true, nil
+}
+
+// fetchMissingKey is a sync handler for encrypted events that fetches the
+// room key from the key backup when it is missing. The crypto helper is
+// waiting for the key and decrypts the event once it is imported. A session
+// the backup doesn't have isn't looked up again, up to maxBackupLookups
+// sessions.
+func (p *MatrixProvider) fetchMissingKey(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsEncrypted()
+	if content.SessionID == "" {
+		return
+	}
+	session, err := p.cryptoHelper.Machine().CryptoStore.GetGroupSession(ctx, evt.RoomID, content.SessionID)
+	if session != nil || errors.Is(err, crypto.ErrGroupSessionWithheld) {
+		return
+	}
+
+	p.backupMu.Lock()
+	if p.backupTried[content.SessionID] {
+		p.backupMu.Unlock()
+		return
+	}
+	if len(p.backupTried) >= maxBackupLookups {
+		p.backupTried = make(map[id.SessionID]bool)
+	}
+	p.backupTried[content.SessionID] = true
+	p.backupMu.Unlock()
+
+	go func() {
+		found, err := p.restoreRoomKey(ctx, evt.RoomID, content.SessionID)
+		if err != nil {
+			slog.Warn("failed to fetch missing room key from backup", "session_id", content.SessionID, "error", err)
+		}
+		if found || err != nil {
+			// Found keys are in the crypto store now, and failed lookups
+			// may be tried again.
+			p.backupMu.Lock()
+			delete(p.backupTried, content.SessionID)
+			p.backupMu.Unlock()
+		}
+	}()
+}
+
+// backupNewKeys uploads the room keys created by a send, such as a new
+// outgoing session for an encrypted room, so they aren't left out of the key
+// backup when no Listen is running. A failed upload doesn't fail the send; the
+// keys stay unmarked and go with the next backup.
+func (p *MatrixProvider) backupNewKeys(ctx context.Context) {
+	if p.cryptoHelper == nil {
+		return
+	}
+	if n, err := p.BackupRoomKeys(ctx); err != nil {
+		slog.Warn("failed to back up room keys", "error", err)
+	} else if n > 0 {
+		slog.Debug("backed up room keys", "count", n)
+	}
+}
+
+// backupLoop uploads new room keys to the key backup every backupInterval
+// until ctx is done.
+func (p *MatrixProvider) backupLoop(ctx context.Context) {
+	ticker := time.NewTicker(backupInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := p.BackupRoomKeys(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("failed to back up room keys", "error", err)
+		} else if n > 0 {
+			slog.Debug("backed up room keys", "count", n)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package messages
+
+import (
+	"encoding/json"
+	"testing"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestBackupSessionData(t *testing.T) {
+	outbound, err := olm.NewOutboundGroupSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := crypto.NewInboundGroupSession("senderkey", "signingkey", "!room:example.org", outbound.Key(), 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := backupSessionData(&keyBackup{key: key, version: "1"}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted backup.EncryptedSessionData[backup.MegolmSessionData]
+	if err := json.Unmarshal(data.SessionData, &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := encrypted.Decrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Algorithm != id.AlgorithmMegolmV1 || decrypted.SenderKey != "senderkey" || decrypted.SenderClaimedKeys.Ed25519 != "signingkey" {
+		t.Errorf("decrypted = %+v", decrypted)
+	}
+
+	// The backed up key must recreate the same session.
+	restored, err := olm.InboundGroupSessionImport([]byte(decrypted.SessionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID() != session.ID() {
+		t.Errorf("restored session ID = %s, want %s", restored.ID(), session.ID())
+	}
+}
@@ -0,0 +1,178 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// listenSyncer wraps the DefaultSyncer used by Listen. Messages dispatched
+// while a sync response is processed are queued and handed to the listener
+// once the whole response is done, with the response's sync token attached
+// to the last one. Once the caller has acknowledged that message the token
+// becomes the listen checkpoint, so a resumed Listen never skips a message
+// that was received but not yet written out. Every other message is recorded
+// as handled when acknowledged, and skipped when a resumed Listen receives
+// it again, so that no message is emitted twice.
+type listenSyncer struct {
+	*mautrix.DefaultSyncer
+	out         chan<- IncomingMessage
+	save        func(ctx context.Context, token string) error
+	saveHandled func(ctx context.Context, key string) error
+	// skip holds the keys of the messages handled after the checkpoint a
+	// resumed Listen started from.
+	skip map[string]bool
+
+	mu         sync.Mutex
+	processing bool
+	pending    []IncomingMessage
+	delivered  int
+	acked      int
+}
+
+// handledKey identifies msg among the messages recorded as handled. The type
+// tells an undecryptable event apart from the same event decrypted later.
+func handledKey(msg *IncomingMessage) string {
+	return msg.Type + " " + msg.EventID
+}
+
+// emit queues msg for delivery at the end of the current sync response, or
+// delivers it right away if it was dispatched outside of one, e.g. when the
+// crypto helper decrypts a message after its room key arrived late.
+func (s *listenSyncer) emit(ctx context.Context, msg IncomingMessage) {
+	if s.skip[handledKey(&msg)] {
+		slog.Debug("skipping message handled before resuming", "event_id", msg.EventID)
+		return
+	}
+	s.mu.Lock()
+	if s.processing {
+		s.pending = append(s.pending, msg)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.deliver(ctx, []IncomingMessage{msg}, "")
+}
+
+func (s *listenSyncer) ProcessResponse(ctx context.Context, res *mautrix.RespSync, since string) error {
+	s.mu.Lock()
+	s.processing = true
+	s.mu.Unlock()
+
+	err := s.DefaultSyncer.ProcessResponse(ctx, res, since)
+
+	s.mu.Lock()
+	msgs := s.pending
+	s.pending = nil
+	s.processing = false
+	// With nothing left to acknowledge, a response without messages can move
+	// the checkpoint forward directly.
+	idle := len(msgs) == 0 && s.delivered == s.acked
+	s.mu.Unlock()
+
+	if err != nil {
+		s.deliver(ctx, msgs, "")
+		return err
+	}
+	if idle {
+		if err := s.save(ctx, res.NextBatch); err != nil {
+			slog.Warn("failed to save listen checkpoint", "error", err)
+		}
+		return nil
+	}
+	s.deliver(ctx, msgs, res.NextBatch)
+	return nil
+}
+
+// OnFailedSync stops the sync loop once the account has to log in again;
+// other failures are retried like the DefaultSyncer does.
+func (s *listenSyncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
+	if errors.Is(err, ErrReauthRequired) {
+		return 0, err
+	}
+	return s.DefaultSyncer.OnFailedSync(res, err)
+}
+
+func (s *listenSyncer) deliver(ctx context.Context, msgs []IncomingMessage, checkpoint string) {
+	for i := range msgs {
+		if i == len(msgs)-1 {
+			msgs[i].checkpoint = checkpoint
+		}
+		s.mu.Lock()
+		s.delivered++
+		s.mu.Unlock()
+		select {
+		case s.out <- msgs[i]:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ack records that msg has been handled and saves the checkpoint it carries.
+func (s *listenSyncer) ack(ctx context.Context, msg *IncomingMessage) error {
+	s.mu.Lock()
+	s.acked++
+	s.mu.Unlock()
+	if msg.checkpoint != "" {
+		return s.save(ctx, msg.checkpoint)
+	}
+	if msg.EventID == "" {
+		return nil
+	}
+	return s.saveHandled(ctx, handledKey(msg))
+}
+
+func (p *MatrixProvider) Checkpoint(ctx context.Context, msg *IncomingMessage) error {
+	if p.listener == nil {
+		return nil
+	}
+	if err := p.listener.ack(ctx, msg); err != nil {
+		return fmt.Errorf("failed to save listen checkpoint: %w", err)
+	}
+	return nil
+}
+
+// ListenErr returns the error that ended the sync loop started by Listen.
+func (p *MatrixProvider) ListenErr() error {
+	return p.listenErr
+}
+
+// fillGaps is a sync handler that fetches the timeline events a limited sync
+// response left out, so that messages sent while the listener was away are
+// not dropped when a room had more than the sync filter's timeline limit.
+func (p *MatrixProvider) fillGaps(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+	if since == "" {
+		return true
+	}
+	for roomID, room := range resp.Rooms.Join {
+		if !room.Timeline.Limited || room.Timeline.PrevBatch == "" {
+			continue
+		}
+		var gap []*event.Event
+		from := room.Timeline.PrevBatch
+		for {
+			slog.Debug("filling timeline gap", "room_id", roomID, "from", from, "to", since)
+			page, err := p.client.Messages(ctx, roomID, from, since, mautrix.DirectionBackward, nil, historyPageSize)
+			if err != nil {
+				slog.Warn("failed to fill timeline gap", "room_id", roomID, "error", err)
+				break
+			}
+			gap = append(gap, page.Chunk...)
+			if page.End == "" || len(page.Chunk) == 0 {
+				break
+			}
+			from = page.End
+		}
+		slices.Reverse(gap)
+		room.Timeline.Events = append(gap, room.Timeline.Events...)
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestListenSyncer(saved *[]string) (*listenSyncer, chan IncomingMessage) {
+	ch := make(chan IncomingMessage)
+	s := &listenSyncer{
+		DefaultSyncer: mautrix.NewDefaultSyncer(),
+		out:           ch,
+		save: func(ctx context.Context, token string) error {
+			*saved = append(*saved, token)
+			return nil
+		},
+		saveHandled: func(ctx context.Context, key string) error {
+			*saved = append(*saved, key)
+			return nil
+		},
+	}
+	s.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		s.emit(ctx, IncomingMessage{Type: TypeMessage, EventID: string(evt.ID)})
+	})
+	return s, ch
+}
+
+func syncResponse(nextBatch string, eventIDs ...string) *mautrix.RespSync {
+	resp := &mautrix.RespSync{NextBatch: nextBatch}
+	resp.Rooms.Join = map[id.RoomID]*mautrix.SyncJoinedRoom{}
+	room := &mautrix.SyncJoinedRoom{}
+	for _, eventID := range eventIDs {
+		content, _ := json.Marshal(map[string]string{"msgtype": "m.text", "body": "hi"})
+		room.Timeline.Events = append(room.Timeline.Events, &event.Event{
+			ID:      id.EventID(eventID),
+			Type:    event.EventMessage,
+			Content: event.Content{VeryRaw: content},
+		})
+	}
+	resp.Rooms.Join["!room:example.org"] = room
+	return resp
+}
+
+func TestListenSyncer_CheckpointAfterBatch(t *testing.T) {
+	var saved []string
+	s, ch := newTestListenSyncer(&saved)
+	ctx := context.Background()
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ProcessResponse(ctx, syncResponse("s1", "$a", "$b"), "s0") }()
+
+	first := <-ch
+	if first.checkpoint != "" {
+		t.Errorf("first message carries checkpoint %q, want none", first.checkpoint)
+	}
+	if err := s.ack(ctx, &first); err != nil {
+		t.Fatal(err)
+	}
+	last := <-ch
+	if last.checkpoint != "s1" {
+		t.Errorf("last message checkpoint: got %q, want s1", last.checkpoint)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0] != "message $a" {
+		t.Fatalf("saved %v before the batch was handled, want only the first message", saved)
+	}
+
+	// An empty response can't move the checkpoint past an unhandled message.
+	if err := s.ProcessResponse(ctx, syncResponse("s2"), "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Fatalf("checkpoint saved with a message outstanding: %v", saved)
+	}
+
+	if err := s.ack(ctx, &last); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ProcessResponse(ctx, syncResponse("s3"), "s2"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"message $a", "s1", "s3"}
+	if !slices.Equal(saved, want) {
+		t.Errorf("saved checkpoints: got %v, want %v", saved, want)
+	}
+}
+
+func TestListenSyncer_SkipsHandled(t *testing.T) {
+	var saved []string
+	s, ch := newTestListenSyncer(&saved)
+	s.skip = map[string]bool{"message $a": true}
+	ctx := context.Background()
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ProcessResponse(ctx, syncResponse("s1", "$a", "$b"), "s0") }()
+
+	msg := <-ch
+	if msg.EventID != "$b" || msg.checkpoint != "s1" {
+		t.Errorf("got %s with checkpoint %q, want $b with s1", msg.EventID, msg.checkpoint)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// loginDeviceName is the display name of the device created by a login.
+const loginDeviceName = "messages"
+
+// ResolveHomeserver turns what the user entered as their homeserver into a
+// homeserver URL, and checks that it is one by calling /versions. input may be
+// a URL, a server name or a user ID; for the last two the homeserver is
+// discovered via /.well-known/matrix/client.
+func ResolveHomeserver(ctx context.Context, input string) (string, error) {
+	return resolveHomeserver(ctx, &http.Client{Timeout: 30 * time.Second}, input)
+}
+
+func resolveHomeserver(ctx context.Context, httpClient *http.Client, input string) (string, error) {
+	homeserverURL := strings.TrimSpace(input)
+	if !strings.Contains(homeserverURL, "://") {
+		serverName := homeserverURL
+		if strings.HasPrefix(serverName, "@") {
+			var err error
+			if _, serverName, err = id.UserID(serverName).Parse(); err != nil {
+				return "", fmt.Errorf("invalid user ID %q: %w", input, err)
+			}
+		}
+		slog.Debug("discovering homeserver", "server_name", serverName)
+		wellKnown, err := mautrix.DiscoverClientAPIWithClient(ctx, httpClient, serverName)
+		if err != nil {
+			return "", fmt.Errorf("failed to discover homeserver for %s: %w", serverName, err)
+		}
+		if wellKnown != nil && wellKnown.Homeserver.BaseURL != "" {
+			homeserverURL = wellKnown.Homeserver.BaseURL
+		} else {
+			// No .well-known: the server name is the homeserver.
+			homeserverURL = "https://" + serverName
+		}
+	}
+	homeserverURL = strings.TrimRight(homeserverURL, "/")
+
+	client, err := mautrix.NewClient(homeserverURL, "", "")
+	if err != nil {
+		return "", fmt.Errorf("invalid homeserver URL %q: %w", homeserverURL, err)
+	}
+	client.Client = httpClient
+	slog.Debug("checking homeserver", "homeserver", homeserverURL)
+	if _, err := client.Versions(ctx); err != nil {
+		return "", fmt.Errorf("%s is not a reachable Matrix homeserver: %w", homeserverURL, err)
+	}
+	return homeserverURL, nil
+}
+
+// LoginFlows returns the login types supported by the homeserver.
+func LoginFlows(ctx context.Context, homeserverURL string) ([]mautrix.AuthType, error) {
+	client, err := mautrix.NewClient(homeserverURL, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	resp, err := client.GetLoginFlows(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login flows: %w", err)
+	}
+	types := make([]mautrix.AuthType, 0, len(resp.Flows))
+	for _, flow := range resp.Flows {
+		types = append(types, flow.Type)
+	}
+	return types, nil
+}
+
+// LoginPassword logs in with m.login.password and returns the credentials of
+// the new device. user may be a full user ID or just the localpart.
+func LoginPassword(ctx context.Context, homeserverURL, user, password string) (*MatrixCredentials, error) {
+	return login(ctx, homeserverURL, &mautrix.ReqLogin{
+		Type:       mautrix.AuthTypePassword,
+		Identifier: mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: user},
+		Password:   password,
+	})
+}
+
+// LoginSSO logs in through the homeserver's single sign-on page. It listens
+// on a local port for the redirect back from the homeserver, calls open with
+// the URL the user has to visit, and exchanges the m.login.token it receives
+// for the credentials of a new device.
+func LoginSSO(ctx context.Context, homeserverURL string, open func(url string)) (*MatrixCredentials, error) {
+	client, err := mautrix.NewClient(homeserverURL, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for SSO callback: %w", err)
+	}
+	defer ln.Close()
+	redirectURL := fmt.Sprintf("http://%s/", ln.Addr())
+
+	tokens := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("loginToken")
+		if token == "" {
+			http.Error(w, "missing loginToken", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Login complete. You can close this tab and return to the terminal.")
+		select {
+		case tokens <- token:
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	slog.Debug("waiting for SSO callback", "redirect_url", redirectURL)
+	open(client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "login", "sso", "redirect"}, map[string]string{
+		"redirectUrl": redirectURL,
+	}))
+	var token string
+	select {
+	case token = <-tokens:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return login(ctx, homeserverURL, &mautrix.ReqLogin{
+		Type:  mautrix.AuthTypeToken,
+		Token: token,
+	})
+}
+
+func login(ctx context.Context, homeserverURL string, req *mautrix.ReqLogin) (*MatrixCredentials, error) {
+	client, err := mautrix.NewClient(homeserverURL, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	req.InitialDeviceDisplayName = loginDeviceName
+	req.RefreshToken = true
+	slog.Debug("logging in", "homeserver", homeserverURL, "type", req.Type)
+	resp, err := client.Login(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in: %w", err)
+	}
+	if resp.AccessToken == "" || resp.DeviceID == "" {
+		return nil, errors.New("login response is missing the access token or device ID")
+	}
+	slog.Debug("logged in", "user_id", resp.UserID, "device_id", resp.DeviceID)
+	return &MatrixCredentials{
+		HomeserverURL: homeserverURL,
+		UserID:        string(resp.UserID),
+		AccessToken:   resp.AccessToken,
+		DeviceID:      string(resp.DeviceID),
+		RefreshToken:  resp.RefreshToken,
+		ExpiresAt:     expiresAt(resp.ExpiresInMS),
+	}, nil
+}
+
+// LoginToken checks an existing access token and returns its credentials,
+// including the user and device IDs the homeserver reports for it.
+func LoginToken(ctx context.Context, homeserverURL, accessToken string) (*MatrixCredentials, error) {
+	client, err := mautrix.NewClient(homeserverURL, "", accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	resp, err := client.Whoami(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check access token: %w", err)
+	}
+	return &MatrixCredentials{
+		HomeserverURL: homeserverURL,
+		UserID:        string(resp.UserID),
+		AccessToken:   accessToken,
+		DeviceID:      string(resp.DeviceID),
+	}, nil
+}
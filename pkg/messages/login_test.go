@@ -0,0 +1,124 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newLoginServer fakes a homeserver's login endpoints, accepting the token
+// "sso-token" for m.login.token logins.
+func newLoginServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/login" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Type       string `json:"type"`
+			Password   string `json:"password"`
+			Token      string `json:"token"`
+			Identifier struct {
+				User string `json:"user"`
+			} `json:"identifier"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid login request: %v", err)
+		}
+		ok := (req.Type == "m.login.password" && req.Identifier.User == "@bot:example.org" && req.Password == "hunter2") ||
+			(req.Type == "m.login.token" && req.Token == "sso-token")
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "Invalid login"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"user_id":      "@bot:example.org",
+			"access_token": "syt_token",
+			"device_id":    "DEVICE",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLoginPassword(t *testing.T) {
+	srv := newLoginServer(t)
+	creds, err := LoginPassword(context.Background(), srv.URL, "@bot:example.org", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessToken != "syt_token" || creds.DeviceID != "DEVICE" || creds.UserID != "@bot:example.org" {
+		t.Errorf("got %+v, want the token, device and user from the login response", creds)
+	}
+
+	if _, err := LoginPassword(context.Background(), srv.URL, "@bot:example.org", "wrong"); err == nil {
+		t.Error("expected an error for a wrong password")
+	}
+}
+
+func TestLoginSSO(t *testing.T) {
+	srv := newLoginServer(t)
+	creds, err := LoginSSO(context.Background(), srv.URL, func(ssoURL string) {
+		// Play the browser: the homeserver redirects back with a login token.
+		u, err := url.Parse(ssoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path != "/_matrix/client/v3/login/sso/redirect" {
+			t.Errorf("SSO URL path = %q", u.Path)
+		}
+		go func() {
+			resp, err := http.Get(u.Query().Get("redirectUrl") + "?loginToken=sso-token")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.DeviceID != "DEVICE" {
+		t.Errorf("device ID = %q, want DEVICE", creds.DeviceID)
+	}
+}
+
+func TestResolveHomeserver(t *testing.T) {
+	var hs *httptest.Server
+	hs = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/matrix/client":
+			json.NewEncoder(w).Encode(map[string]any{"m.homeserver": map[string]string{"base_url": hs.URL + "/"}})
+		case "/_matrix/client/versions":
+			json.NewEncoder(w).Encode(map[string]any{"versions": []string{"v1.11"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer hs.Close()
+	serverName := strings.TrimPrefix(hs.URL, "https://")
+	ctx := context.Background()
+
+	for _, input := range []string{"@bot:" + serverName, serverName, hs.URL, " " + hs.URL + "/ "} {
+		got, err := resolveHomeserver(ctx, hs.Client(), input)
+		if err != nil {
+			t.Errorf("resolveHomeserver(%q): %v", input, err)
+		} else if got != hs.URL {
+			t.Errorf("resolveHomeserver(%q) = %q, want %q", input, got, hs.URL)
+		}
+	}
+
+	if _, err := resolveHomeserver(ctx, hs.Client(), hs.URL+"/not-matrix"); err == nil {
+		t.Error("expected an error for a URL that is not a homeserver")
+	}
+	if _, err := resolveHomeserver(ctx, hs.Client(), "@no-server"); err == nil {
+		t.Error("expected an error for an invalid user ID")
+	}
+}
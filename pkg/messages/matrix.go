@@ -3,16 +3,21 @@ package messages
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	_ "go.mau.fi/util/dbutil/litestream"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/crypto/cryptohelper"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -21,17 +26,29 @@ type MatrixCredentials struct {
 	UserID        string `json:"user_id"`
 	AccessToken   string `json:"access_token"`
 	DeviceID      string `json:"device_id,omitempty"`
+	RefreshToken  string `json:"refresh_token,omitempty"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"` // access token expiry, Unix ms
 }
 
 type MatrixProvider struct {
 	client       *mautrix.Client
 	cryptoHelper *cryptohelper.CryptoHelper
+	syncer       *mautrix.DefaultSyncer
+	syncMu       sync.Mutex
+	listener     *listenSyncer
+	listenErr    error
+	syncStore    *syncStore
+	names        *nameCache
 	userID       id.UserID
 	dir          string
+
+	backupMu    sync.Mutex
+	keyBackup   *keyBackup
+	backupTried map[id.SessionID]bool
 }
 
 func NewMatrixProvider(dir string) (*MatrixProvider, error) {
-	return &MatrixProvider{dir: dir}, nil
+	return &MatrixProvider{dir: dir, names: newNameCache(), backupTried: make(map[id.SessionID]bool)}, nil
 }
 
 func (p *MatrixProvider) SaveCredentials(creds *MatrixCredentials) error {
@@ -43,7 +60,21 @@ func (p *MatrixProvider) SaveCredentials(creds *MatrixCredentials) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal credentials: %w", err)
 	}
-	if err := os.WriteFile(credsPath, data, 0600); err != nil {
+	// Write to a temporary file and rename it into place, so a crash or a
+	// concurrent LoadCredentials never sees a partly written file.
+	tmp, err := os.CreateTemp(p.dir, "matrix_credentials.*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write credentials: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write credentials: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write credentials: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), credsPath); err != nil {
 		return fmt.Errorf("failed to write credentials: %w", err)
 	}
 	return nil
@@ -83,8 +114,32 @@ func (p *MatrixProvider) Initialize() error {
 		client.DeviceID = id.DeviceID(creds.DeviceID)
 		slog.Debug("using device ID", "device_id", creds.DeviceID)
 	}
+	client.Client.Transport = newTokenRefresher(client, creds, p.LoadCredentials, p.SaveCredentials)
 	p.client = client
 
+	// Persist sync tokens and room state so commands can resume from the
+	// last sync instead of doing a full initial sync every time.
+	syncPath := filepath.Join(p.dir, "sync.db")
+	slog.Debug("opening sync store", "db_path", syncPath)
+	store, err := newSyncStore(syncPath)
+	if err != nil {
+		return fmt.Errorf("failed to open sync store: %w", err)
+	}
+	if err := store.Upgrade(context.Background()); err != nil {
+		store.Close()
+		return fmt.Errorf("failed to upgrade sync store: %w", err)
+	}
+	p.syncStore = store
+	client.Store = store
+	client.StateStore = store.state
+	syncer := client.Syncer.(*mautrix.DefaultSyncer)
+	p.syncer = syncer
+	syncer.OnEvent(client.StateStoreSyncHandler)
+	syncer.OnEventType(event.StateMember, p.handleMemberEvent)
+	syncer.OnEventType(event.StateRoomName, p.handleRoomNameEvent)
+	syncer.OnEventType(event.StateCanonicalAlias, p.handleRoomNameEvent)
+	syncer.OnSync(p.handleRoomSummaries)
+
 	// Set up E2EE using a SQLite database for key storage
 	dbPath := filepath.Join(p.dir, "crypto.db")
 	slog.Debug("initializing E2EE crypto helper", "db_path", dbPath)
@@ -97,6 +152,8 @@ func (p *MatrixProvider) Initialize() error {
 	}
 	p.cryptoHelper = helper
 	client.Crypto = helper
+	// Runs after the crypto helper's own handler has tried to decrypt.
+	syncer.OnEventType(event.EventEncrypted, p.fetchMissingKey)
 
 	slog.Debug("matrix provider initialized successfully")
 	return nil
@@ -105,82 +162,370 @@ func (p *MatrixProvider) Initialize() error {
 // Listen uses the Matrix sync loop to long-poll for incoming messages.
 // Returns a channel of IncomingMessage that is closed when ctx is cancelled.
 // Handles both plaintext and encrypted messages.
-func (p *MatrixProvider) Listen(ctx context.Context) (<-chan IncomingMessage, error) {
+func (p *MatrixProvider) Listen(ctx context.Context, opts ListenOptions) (<-chan IncomingMessage, error) {
+	var checkpoint string
+	var handled map[string]bool
+	if opts.Resume {
+		var err error
+		checkpoint, err = p.syncStore.LoadCheckpoint(ctx, p.userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load listen checkpoint: %w", err)
+		}
+		handled, err = p.syncStore.LoadHandled(ctx, p.userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load listen checkpoint: %w", err)
+		}
+	}
+	if checkpoint != "" {
+		// Rewind the sync loop to the checkpoint so everything received
+		// since is emitted.
+		slog.Debug("resuming from listen checkpoint", "since", checkpoint)
+		if err := p.syncStore.SaveNextBatch(ctx, p.userID, checkpoint); err != nil {
+			return nil, fmt.Errorf("failed to save sync token: %w", err)
+		}
+	} else {
+		// Catch up before registering the message handler so that only
+		// messages arriving after startup are emitted.
+		if err := p.catchUp(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	ch := make(chan IncomingMessage)
-	syncer := p.client.Syncer.(*mautrix.DefaultSyncer)
+	listener := &listenSyncer{
+		DefaultSyncer: p.syncer,
+		out:           ch,
+		save: func(ctx context.Context, token string) error {
+			return p.syncStore.SaveCheckpoint(ctx, p.userID, token)
+		},
+		saveHandled: func(ctx context.Context, key string) error {
+			return p.syncStore.SaveHandled(ctx, p.userID, key)
+		},
+		skip: handled,
+	}
+	p.listener = listener
+	p.client.Syncer = listener
+	p.syncer.OnSync(p.fillGaps)
 
 	// The crypto helper (client.Crypto) automatically decrypts encrypted
-	// events and re-dispatches them as EventMessage, so we only need this handler.
-	syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+	// events and re-dispatches them with their decrypted type, so these
+	// handlers see both plaintext and encrypted events.
+	handle := func(ctx context.Context, evt *event.Event) {
 		slog.Debug("received event", "type", evt.Type.Type, "sender", evt.Sender, "room_id", evt.RoomID, "event_id", evt.ID)
-		if evt.Sender == p.userID {
-			slog.Debug("skipping own message", "event_id", evt.ID)
-			return
-		}
-
-		content := evt.Content.AsMessage()
-		if content == nil {
-			slog.Debug("skipping non-message event", "event_id", evt.ID)
-			return
-		}
-
-		msg := IncomingMessage{
-			RoomID:     string(evt.RoomID),
-			RoomName:   p.getRoomDisplayName(ctx, evt.RoomID),
-			Sender:     string(evt.Sender),
-			SenderName: string(evt.Sender),
-			Text:       content.Body,
-			Timestamp:  time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
-			EventID:    string(evt.ID),
+		if msg := p.toListenMessage(ctx, evt, opts); msg != nil {
+			listener.emit(ctx, *msg)
 		}
+	}
+	p.syncer.OnEventType(event.EventMessage, handle)
+	p.syncer.OnEventType(event.EventRedaction, handle)
+	if opts.Reactions {
+		p.syncer.OnEventType(event.EventReaction, handle)
+	}
 
-		select {
-		case ch <- msg:
-		case <-ctx.Done():
-		}
-	})
+	// Events the crypto helper gives up on are emitted as undecryptable and
+	// decrypted again if their room key turns up later.
+	utd := newUndecryptableEvents()
+	p.cryptoHelper.DecryptErrorCallback = func(evt *event.Event, err error) {
+		p.handleUndecryptable(ctx, listener, utd, evt, err)
+	}
+	p.cryptoHelper.Machine().SessionReceived = func(_ context.Context, _ id.RoomID, sessionID id.SessionID, _ uint32) {
+		go p.retryUndecryptable(ctx, listener, utd, sessionID, opts)
+	}
 
 	p.client.SyncPresence = event.PresenceOffline
 
+	go p.backupLoop(ctx)
 	go func() {
 		defer close(ch)
 		if err := p.client.SyncWithContext(ctx); err != nil && ctx.Err() == nil {
 			slog.Error("sync error", "error", err)
+			p.listenErr = err
 		}
 	}()
 
 	return ch, nil
 }
 
+// toListenMessage converts an event received by Listen to the
+// IncomingMessage it emits, or returns nil if it isn't emitted: the
+// account's own events, reactions unless opts.Reactions is set, and events
+// that aren't messages.
+func (p *MatrixProvider) toListenMessage(ctx context.Context, evt *event.Event, opts ListenOptions) *IncomingMessage {
+	if evt.Sender == p.userID {
+		slog.Debug("skipping own event", "event_id", evt.ID)
+		return nil
+	}
+	var msg *IncomingMessage
+	switch evt.Type {
+	case event.EventMessage:
+		msg = p.toIncomingMessage(ctx, evt)
+	case event.EventRedaction:
+		msg = p.toIncomingRedaction(ctx, evt)
+	case event.EventReaction:
+		if opts.Reactions {
+			msg = p.toIncomingReaction(ctx, evt)
+		}
+	}
+	if msg == nil {
+		slog.Debug("skipping non-message event", "event_id", evt.ID)
+	}
+	return msg
+}
+
+// toIncomingMessage converts a (decrypted) m.room.message event to an
+// IncomingMessage. It returns nil if evt is not a message.
+func (p *MatrixProvider) toIncomingMessage(ctx context.Context, evt *event.Event) *IncomingMessage {
+	content := evt.Content.AsMessage()
+	if content == nil {
+		return nil
+	}
+	// Strip the quoted reply fallback so Text only holds the new message.
+	content.RemoveReplyFallback()
+	msg := &IncomingMessage{
+		Type:          TypeMessage,
+		RoomID:        string(evt.RoomID),
+		RoomName:      p.getRoomDisplayName(ctx, evt.RoomID),
+		Sender:        string(evt.Sender),
+		SenderName:    p.getSenderName(ctx, evt.RoomID, evt.Sender),
+		Text:          content.Body,
+		MsgType:       string(content.MsgType),
+		Format:        string(content.Format),
+		FormattedBody: content.FormattedBody,
+		ReplyTo:       string(content.RelatesTo.GetNonFallbackReplyTo()),
+		ThreadID:      string(content.RelatesTo.GetThreadParent()),
+		Attachment:    attachmentFromContent(content),
+		Timestamp:     time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
+		EventID:       string(evt.ID),
+	}
+	if content.RelatesTo.GetReplaceID() != "" {
+		applyEdit(msg, content)
+	}
+	return msg
+}
+
 func (p *MatrixProvider) Close() error {
+	var err error
 	if p.cryptoHelper != nil {
-		return p.cryptoHelper.Close()
+		err = p.cryptoHelper.Close()
 	}
-	return nil
+	if p.syncStore != nil {
+		if serr := p.syncStore.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
 }
 
-func (p *MatrixProvider) Send(ctx context.Context, roomID string, text string) error {
-	slog.Debug("preparing to send message", "room_id", roomID, "text_length", len(text))
-	// Do an initial sync so the crypto helper learns room encryption state
-	// and other users' device keys — required for encrypting outgoing messages.
-	slog.Debug("performing initial sync for E2EE key exchange")
-	resp, err := p.client.SyncRequest(ctx, 0, "", "", true, event.PresenceOffline)
+func (p *MatrixProvider) Send(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error) {
+	result, err := p.sendOnce(ctx, roomID, msg)
 	if err != nil {
-		return fmt.Errorf("initial sync failed: %w", err)
+		return nil, classifySendError(err)
 	}
-	syncer := p.client.Syncer.(*mautrix.DefaultSyncer)
-	if err := syncer.ProcessResponse(ctx, resp, ""); err != nil {
-		return fmt.Errorf("failed to process sync response: %w", err)
+	p.backupNewKeys(ctx)
+	return result, nil
+}
+
+// classifySendError wraps errors that may go away on retry in a
+// TemporaryError: requests that got no response, homeserver errors and rate
+// limiting, with the delay the homeserver asked for.
+func classifySendError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrReauthRequired) {
+		return err
+	}
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+	if httpErr.Response == nil {
+		return &TemporaryError{Err: err}
+	}
+	switch code := httpErr.Response.StatusCode; {
+	case code == http.StatusTooManyRequests:
+		temp := &TemporaryError{Err: err, RateLimited: true}
+		if httpErr.RespError != nil {
+			if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+				temp.RetryAfter = time.Duration(ms) * time.Millisecond
+			}
+		}
+		return temp
+	case code >= 500:
+		return &TemporaryError{Err: err}
+	}
+	return err
+}
+
+// sendOnce sends msg unless its transaction ID was already sent.
+func (p *MatrixProvider) sendOnce(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error) {
+	if msg.TxnID == "" {
+		return p.send(ctx, roomID, msg)
+	}
+	// A message with a transaction ID that was already sent to the same room
+	// is not sent again, so rerunning a batch that was interrupted doesn't double-post.
+	sent, err := p.syncStore.GetSentEvent(ctx, roomID, msg.TxnID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up transaction %s: %w", msg.TxnID, err)
+	}
+	if sent != nil {
+		slog.Debug("transaction already sent, skipping", "txn_id", msg.TxnID, "event_id", sent.EventID)
+		return sent, nil
+	}
+	result, err := p.send(ctx, roomID, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.syncStore.SaveSentEvent(ctx, msg.TxnID, result); err != nil {
+		slog.Warn("failed to record sent transaction", "txn_id", msg.TxnID, "error", err)
+	}
+	return result, nil
+}
+
+func (p *MatrixProvider) send(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error) {
+	if msg.Redact != "" {
+		return p.redact(ctx, id.RoomID(roomID), id.EventID(msg.Redact), msg.Reason, msg.TxnID)
+	}
+	if msg.Reaction != "" {
+		return p.sendReaction(ctx, id.RoomID(roomID), id.EventID(msg.ReactsTo), msg.Reaction, msg.TxnID)
+	}
+	if msg.Replaces != "" && (msg.File != "" || msg.ReplyTo != "" || msg.ThreadID != "") {
+		return nil, fmt.Errorf("an edit can only replace the text of a message, not add a file, reply or thread")
+	}
+	slog.Debug("preparing to send message", "room_id", roomID, "text_length", len(msg.Text), "format", msg.Format)
+	content, err := renderContent(msg.Text, msg.Format)
+	if err != nil {
+		return nil, err
+	}
+	// The crypto helper needs up-to-date room encryption state and device
+	// keys to encrypt outgoing messages.
+	if err := p.catchUp(ctx); err != nil {
+		return nil, err
+	}
+	if msg.File != "" {
+		if err := p.attachFile(ctx, id.RoomID(roomID), content, msg.File); err != nil {
+			return nil, err
+		}
+	}
+	if msg.ReplyTo != "" || msg.ThreadID != "" {
+		p.setRelation(ctx, id.RoomID(roomID), content, id.EventID(msg.ReplyTo), id.EventID(msg.ThreadID))
+	}
+	if msg.Replaces != "" {
+		content.SetEdit(id.EventID(msg.Replaces))
 	}
-	// Best-effort save of sync token; may fail for read-only stores.
-	_ = p.client.Store.SaveNextBatch(ctx, p.userID, resp.NextBatch)
 
 	slog.Debug("sending message", "room_id", roomID)
-	_, err = p.client.SendText(ctx, id.RoomID(roomID), text)
+	resp, err := p.client.SendMessageEvent(ctx, id.RoomID(roomID), event.EventMessage, content, mautrix.ReqSendEvent{TransactionID: msg.TxnID})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	slog.Debug("message sent successfully", "room_id", roomID, "event_id", resp.EventID)
+	return newSendResult(id.RoomID(roomID), resp), nil
+}
+
+// newSendResult describes the event created by a successful send request.
+// The response doesn't include the event's origin_server_ts, so the result
+// records the local time of the send instead.
+func newSendResult(roomID id.RoomID, resp *mautrix.RespSendEvent) *SendResult {
+	return &SendResult{
+		RoomID:  string(roomID),
+		EventID: string(resp.EventID),
+		SentAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// fetchEvent fetches a single room event, decrypting it if it is encrypted.
+func (p *MatrixProvider) fetchEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := p.client.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch event %s: %w", eventID, err)
+	}
+	return p.prepareEvent(ctx, roomID, evt)
+}
+
+// prepareEvent parses the content of an event fetched outside the sync loop
+// and decrypts it if it is encrypted.
+func (p *MatrixProvider) prepareEvent(ctx context.Context, roomID id.RoomID, evt *event.Event) (*event.Event, error) {
+	evt.RoomID = roomID
+	if evt.StateKey != nil {
+		evt.Type.Class = event.StateEventType
+	} else {
+		evt.Type.Class = event.MessageEventType
+	}
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrUnsupportedContentType) {
+		return nil, fmt.Errorf("failed to parse event %s: %w", evt.ID, err)
+	}
+	if evt.Type == event.EventEncrypted {
+		decrypted, err := p.cryptoHelper.Decrypt(ctx, evt)
+		if errors.Is(err, crypto.ErrNoSessionFound) {
+			content := evt.Content.AsEncrypted()
+			if found, rerr := p.restoreRoomKey(ctx, roomID, content.SessionID); rerr != nil {
+				slog.Debug("failed to fetch room key from backup", "session_id", content.SessionID, "error", rerr)
+			} else if found {
+				decrypted, err = p.cryptoHelper.Decrypt(ctx, evt)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt event %s: %w", evt.ID, err)
+		}
+		evt = decrypted
+	}
+	return evt, nil
+}
+
+// renderContent builds an m.room.message content from text in the given
+// format. Markdown and HTML are sent as org.matrix.custom.html with a
+// plaintext fallback in body.
+func renderContent(text, textFormat string) (*event.MessageEventContent, error) {
+	switch textFormat {
+	case "", FormatPlain:
+		return &event.MessageEventContent{MsgType: event.MsgText, Body: text}, nil
+	case FormatMarkdown:
+		content := format.RenderMarkdown(text, true, false)
+		return &content, nil
+	case FormatHTML:
+		content := format.HTMLToContent(text)
+		return &content, nil
+	default:
+		return nil, fmt.Errorf("unknown message format %q (must be plain, markdown or html)", textFormat)
+	}
+}
+
+// catchUp does an incremental sync from the stored sync token so the crypto
+// helper learns about new rooms, members and device keys. It does nothing if
+// the stored state was synced within syncFreshness, e.g. by an earlier Send
+// or a running listener. Concurrent calls wait for the first one's sync.
+func (p *MatrixProvider) catchUp(ctx context.Context) error {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	lastSync, err := p.syncStore.LastSync(ctx, p.userID)
+	if err != nil {
+		return fmt.Errorf("failed to load sync state: %w", err)
+	}
+	if time.Since(lastSync) < syncFreshness {
+		slog.Debug("sync state is fresh, skipping catch-up sync", "last_sync", lastSync)
+		return nil
+	}
+	since, err := p.syncStore.LoadNextBatch(ctx, p.userID)
+	if err != nil {
+		return fmt.Errorf("failed to load sync token: %w", err)
+	}
+	filterID, err := p.syncStore.LoadFilterID(ctx, p.userID)
+	if err != nil {
+		return fmt.Errorf("failed to load filter ID: %w", err)
+	}
+	slog.Debug("performing catch-up sync", "since", since)
+	resp, err := p.client.FullSyncRequest(ctx, mautrix.ReqSync{
+		Since:       since,
+		FilterID:    filterID,
+		SetPresence: event.PresenceOffline,
+	})
+	if err != nil {
+		return fmt.Errorf("catch-up sync failed: %w", err)
+	}
+	if err := p.syncer.ProcessResponse(ctx, resp, since); err != nil {
+		return fmt.Errorf("failed to process sync response: %w", err)
+	}
+	if err := p.syncStore.SaveNextBatch(ctx, p.userID, resp.NextBatch); err != nil {
+		return fmt.Errorf("failed to save sync token: %w", err)
 	}
-	slog.Debug("message sent successfully", "room_id", roomID)
 	return nil
 }
 
@@ -221,6 +566,10 @@ func (p *MatrixProvider) FindOrCreateDM(ctx context.Context, userID string) (str
 }
 
 func (p *MatrixProvider) ListRooms(ctx context.Context) ([]Room, error) {
+	// Room names are computed from the synced state store.
+	if err := p.catchUp(ctx); err != nil {
+		return nil, err
+	}
 	resp, err := p.client.JoinedRooms(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list joined rooms: %w", err)
@@ -234,19 +583,3 @@ func (p *MatrixProvider) ListRooms(ctx context.Context) ([]Room, error) {
 	}
 	return rooms, nil
 }
-
-func (p *MatrixProvider) getRoomDisplayName(ctx context.Context, roomID id.RoomID) string {
-	var nameContent event.RoomNameEventContent
-	err := p.client.StateEvent(ctx, roomID, event.StateRoomName, "", &nameContent)
-	if err == nil && nameContent.Name != "" {
-		return nameContent.Name
-	}
-
-	var aliasContent event.CanonicalAliasEventContent
-	err = p.client.StateEvent(ctx, roomID, event.StateCanonicalAlias, "", &aliasContent)
-	if err == nil && aliasContent.Alias != "" {
-		return string(aliasContent.Alias)
-	}
-
-	return string(roomID)
-}
@@ -0,0 +1,178 @@
+package messages
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRenderContent_Plain(t *testing.T) {
+	for _, f := range []string{"", FormatPlain} {
+		content, err := renderContent("**hi**", f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content.Body != "**hi**" || content.Format != "" || content.FormattedBody != "" {
+			t.Errorf("format %q: got body=%q format=%q formatted=%q", f, content.Body, content.Format, content.FormattedBody)
+		}
+	}
+}
+
+func TestRenderContent_Markdown(t *testing.T) {
+	content, err := renderContent("**bold** and `code`", FormatMarkdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Format != event.FormatHTML {
+		t.Errorf("format: got %q, want %q", content.Format, event.FormatHTML)
+	}
+	if !strings.Contains(content.FormattedBody, "<strong>bold</strong>") {
+		t.Errorf("formatted body missing bold: %q", content.FormattedBody)
+	}
+	if strings.Contains(content.Body, "<") {
+		t.Errorf("body should be plaintext: %q", content.Body)
+	}
+}
+
+func TestRenderContent_HTML(t *testing.T) {
+	content, err := renderContent("<b>alert</b>", FormatHTML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.FormattedBody != "<b>alert</b>" {
+		t.Errorf("formatted body: got %q", content.FormattedBody)
+	}
+	if strings.Contains(content.Body, "<b>") {
+		t.Errorf("body should be plaintext: %q", content.Body)
+	}
+}
+
+func TestRenderContent_Unknown(t *testing.T) {
+	if _, err := renderContent("hi", "rtf"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestToIncomingMessage(t *testing.T) {
+	p := newTestNameProvider(t, http.NotFound)
+	room := id.RoomID("!room:example.org")
+	p.names.setRoom(room, "General")
+	p.names.setMember(room, "@alice:example.org", "Alice")
+
+	tests := []struct {
+		name    string
+		content *event.MessageEventContent
+		want    IncomingMessage
+	}{{
+		name:    "text",
+		content: &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"},
+		want:    IncomingMessage{Text: "hello", MsgType: "m.text"},
+	}, {
+		name:    "notice",
+		content: &event.MessageEventContent{MsgType: event.MsgNotice, Body: "build passed"},
+		want:    IncomingMessage{Text: "build passed", MsgType: "m.notice"},
+	}, {
+		name: "formatted",
+		content: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          "bold",
+			Format:        event.FormatHTML,
+			FormattedBody: "<b>bold</b>",
+		},
+		want: IncomingMessage{Text: "bold", MsgType: "m.text", Format: "org.matrix.custom.html", FormattedBody: "<b>bold</b>"},
+	}, {
+		name: "reply in thread",
+		content: &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "on it",
+			RelatesTo: &event.RelatesTo{
+				Type:      event.RelThread,
+				EventID:   "$root",
+				InReplyTo: &event.InReplyTo{EventID: "$orig"},
+			},
+		},
+		want: IncomingMessage{Text: "on it", MsgType: "m.text", ReplyTo: "$orig", ThreadID: "$root"},
+	}, {
+		name: "attachment",
+		content: &event.MessageEventContent{
+			MsgType:  event.MsgImage,
+			Body:     "cat.png",
+			URL:      "mxc://example.org/abc",
+			Info:     &event.FileInfo{MimeType: "image/png", Size: 1234, Width: 10, Height: 20},
+			FileName: "cat.png",
+		},
+		want: IncomingMessage{Text: "cat.png", MsgType: "m.image", Attachment: &Attachment{
+			URL:      "mxc://example.org/abc",
+			MimeType: "image/png",
+			Size:     1234,
+			FileName: "cat.png",
+			Width:    10,
+			Height:   20,
+		}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evt := &event.Event{
+				Type:      event.EventMessage,
+				ID:        "$event",
+				RoomID:    room,
+				Sender:    "@alice:example.org",
+				Timestamp: 1772704800000,
+				Content:   event.Content{Parsed: tt.content},
+			}
+			want := tt.want
+			want.Type = TypeMessage
+			want.RoomID = "!room:example.org"
+			want.RoomName = "General"
+			want.Sender = "@alice:example.org"
+			want.SenderName = "Alice"
+			want.Timestamp = "2026-03-05T10:00:00Z"
+			want.EventID = "$event"
+
+			got := p.toIncomingMessage(context.Background(), evt)
+			if got == nil || !reflect.DeepEqual(*got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSaveCredentials(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewMatrixProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"first", "second"} {
+		if err := p.SaveCredentials(&MatrixCredentials{AccessToken: token}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	creds, err := p.LoadCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds == nil || creds.AccessToken != "second" {
+		t.Errorf("loaded %+v, want the second credentials", creds)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the credentials", len(entries))
+	}
+	info, err := os.Stat(dir + "/matrix_credentials.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credentials mode %v, want 0600", info.Mode().Perm())
+	}
+}
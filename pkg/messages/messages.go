@@ -2,29 +2,162 @@ package messages
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/arjungandhi/messages/pkg/config"
 )
 
-// IncomingMessage is a message received from a room.
+// ErrReauthRequired is returned when the homeserver no longer accepts the
+// account's access token and it can't be refreshed, so the account has to
+// log in again.
+var ErrReauthRequired = errors.New("re-authentication required")
+
+// IncomingMessage is a message or other event received from a room. Type
+// tells the kinds apart; fields that don't apply to a kind are left empty.
 type IncomingMessage struct {
+	// Type is TypeMessage, TypeReaction, TypeEdit, TypeRedaction or
+	// TypeUndecryptable.
+	Type       string `json:"type"`
 	RoomID     string `json:"room_id"`
 	RoomName   string `json:"room_name"`
 	Sender     string `json:"sender"`
 	SenderName string `json:"sender_name"`
-	Text       string `json:"text"`
-	Timestamp  string `json:"timestamp"`
-	EventID    string `json:"event_id"`
+	// Text is the message body; for an edit, the new content.
+	Text string `json:"text"`
+	// MsgType is the Matrix msgtype (m.text, m.notice, m.emote, m.image, ...).
+	MsgType string `json:"msgtype,omitempty"`
+	// Format and FormattedBody are set when the message carries rich markup.
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+	// ReplyTo and ThreadID are set when the message is a reply or part of a
+	// thread.
+	ReplyTo  string `json:"reply_to,omitempty"`
+	ThreadID string `json:"thread_id,omitempty"`
+	// Attachment is set for media messages (m.image, m.file, ...).
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// Reaction is the emoji of a reaction and ReactsTo the reacted-to event.
+	Reaction string `json:"reaction,omitempty"`
+	ReactsTo string `json:"reacts_to,omitempty"`
+	// Replaces is the event changed by an edit.
+	Replaces string `json:"replaces,omitempty"`
+	// Redacts is the event removed by a redaction.
+	Redacts string `json:"redacts,omitempty"`
+	// Reason is the optional reason of a redaction, or why an undecryptable
+	// event couldn't be decrypted.
+	Reason string `json:"reason,omitempty"`
+	// SessionID is the Megolm session an undecryptable event needs.
+	SessionID string `json:"session_id,omitempty"`
+	// Late is set on a message that was emitted as undecryptable before and
+	// could be decrypted once its room key arrived.
+	Late      bool   `json:"late,omitempty"`
+	Timestamp string `json:"timestamp"`
+	EventID   string `json:"event_id"`
+
+	// checkpoint is the sync token to save as the listen checkpoint once
+	// this message has been handled (see Client.Checkpoint).
+	checkpoint string
+}
+
+// Attachment describes a file attached to a message. Encryption is set when
+// the file is end-to-end encrypted and holds what is needed to decrypt it.
+type Attachment struct {
+	URL        string                `json:"url"`
+	MimeType   string                `json:"mimetype,omitempty"`
+	Size       int                   `json:"size,omitempty"`
+	FileName   string                `json:"filename"`
+	Width      int                   `json:"width,omitempty"`
+	Height     int                   `json:"height,omitempty"`
+	Encryption *AttachmentEncryption `json:"encryption,omitempty"`
+}
+
+// AttachmentEncryption holds the AES-CTR key, IV and SHA-256 hash of an
+// encrypted attachment, encoded as in the Matrix spec.
+type AttachmentEncryption struct {
+	Key     string `json:"key"`
+	IV      string `json:"iv"`
+	SHA256  string `json:"sha256"`
+	Version string `json:"v"`
 }
 
 // OutgoingMessage is a message to send to a room or user.
 // Either RoomID or UserID must be set. If UserID is set, a DM room is found or created.
 type OutgoingMessage struct {
+	// ID is an optional caller-chosen identifier that the CLI echoes back in
+	// send results, so results can be matched to input lines.
+	ID string `json:"id"`
+	// TxnID is an optional transaction ID passed to the homeserver. A message
+	// whose TxnID was sent to the same room from this account in the last 7
+	// days is not sent again; Send returns the original result instead.
+	TxnID  string `json:"txn_id"`
 	RoomID string `json:"room_id"`
 	UserID string `json:"user_id"`
 	Text   string `json:"text"`
+	// Format is one of FormatPlain (the default), FormatMarkdown or
+	// FormatHTML.
+	Format string `json:"format"`
+	// ReplyTo is an event ID to reply to, ThreadID the root event of a
+	// thread to post in.
+	ReplyTo  string `json:"reply_to"`
+	ThreadID string `json:"thread_id"`
+	// File is a path to a file to upload and send as an attachment; Text is
+	// then the caption.
+	File string `json:"file"`
+	// Reaction is an emoji (or other key) to react to the ReactsTo event with
+	// instead of sending a message.
+	Reaction string `json:"reaction"`
+	ReactsTo string `json:"reacts_to"`
+	// Replaces is an event ID to edit, replacing its text with Text.
+	Replaces string `json:"replaces"`
+	// Redact is an event ID to redact instead of sending a message, with an
+	// optional Reason.
+	Redact string `json:"redact"`
+	Reason string `json:"reason"`
+}
+
+// SendResult describes the event created by Send. SentAt is when the send
+// request succeeded by the local clock, in RFC 3339 format, not the event's
+// origin_server_ts.
+type SendResult struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+	SentAt  string `json:"sent_at"`
+}
+
+// Message formats accepted in OutgoingMessage.Format.
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// Types of IncomingMessage.
+const (
+	TypeMessage       = "message"
+	TypeReaction      = "reaction"
+	TypeEdit          = "edit"
+	TypeRedaction     = "redaction"
+	TypeUndecryptable = "undecryptable"
+)
+
+// HistoryOptions controls which past messages History returns. Zero values
+// mean no bound.
+type HistoryOptions struct {
+	Limit  int       // maximum number of messages
+	Since  time.Time // only messages sent at or after this time
+	Before string    // only messages before this event ID
+}
+
+// ListenOptions controls where Listen starts and what it emits. With Resume
+// set, Listen first emits every message received since the last checkpoint
+// instead of only messages arriving after startup. With Reactions set,
+// reactions are emitted as well as messages.
+type ListenOptions struct {
+	Resume    bool
+	Reactions bool
 }
 
 // Room represents a joined room/channel.
@@ -33,13 +166,55 @@ type Room struct {
 	Name string `json:"name"`
 }
 
+// Device is a logged-in session of the account. LastSeen is an RFC 3339
+// timestamp, empty if the homeserver doesn't report it. Current marks the
+// device this client uses.
+type Device struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	LastSeen   string `json:"last_seen,omitempty"`
+	LastSeenIP string `json:"last_seen_ip,omitempty"`
+	Current    bool   `json:"current"`
+}
+
+// SAS is the short authentication string compared by both sides of a device
+// verification: seven emoji with their names, and three numbers for when
+// emoji can't be shown. Either may be empty.
+type SAS struct {
+	Emoji      []string
+	EmojiNames []string
+	Decimals   []int
+}
+
+// VerifyOptions controls Verify. With UserID set, Verify asks that user to
+// verify (the account's own user ID verifies one of its other devices);
+// otherwise it waits for an incoming request and asks Accept whether to take
+// it. Confirm shows the SAS and reports whether the other side shows the same.
+type VerifyOptions struct {
+	UserID  string
+	Accept  func(userID, deviceID string) bool
+	Confirm func(sas SAS) bool
+}
+
 // Provider is the interface that must be satisfied by a messaging backend.
 type Provider interface {
 	Initialize() error
-	Listen(ctx context.Context) (<-chan IncomingMessage, error)
-	Send(ctx context.Context, roomID string, text string) error
+	Listen(ctx context.Context, opts ListenOptions) (<-chan IncomingMessage, error)
+	ListenErr() error
+	Checkpoint(ctx context.Context, msg *IncomingMessage) error
+	Send(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error)
 	FindOrCreateDM(ctx context.Context, userID string) (string, error)
 	ListRooms(ctx context.Context) ([]Room, error)
+	Download(ctx context.Context, roomID string, ref string) ([]byte, *Attachment, error)
+	History(ctx context.Context, roomID string, opts HistoryOptions) ([]IncomingMessage, error)
+	Devices(ctx context.Context) ([]Device, error)
+	RenameDevice(ctx context.Context, deviceID, name string) error
+	DeleteDevice(ctx context.Context, deviceID string, password func() (string, error)) error
+	Verify(ctx context.Context, opts VerifyOptions) error
+	BootstrapCrossSigning(ctx context.Context, password func() (string, error), replace bool) (string, error)
+	RecoverCrossSigning(ctx context.Context, secret string) error
+	RestoreKeyBackup(ctx context.Context, secret string) (int, error)
+	BackupRoomKeys(ctx context.Context) (int, error)
 	Close() error
 }
 
@@ -47,6 +222,9 @@ type Provider interface {
 type Client struct {
 	Config   *config.Config
 	provider Provider
+	dir      string
+	outboxMu sync.Mutex
+	outbox   *outbox
 }
 
 // New creates a new Client for the given account. If cfg is nil, default config is used.
@@ -83,26 +261,49 @@ func New(cfg *config.Config, accountName string) (*Client, error) {
 		return nil, fmt.Errorf("%w. Run 'messages account add %s' to set up credentials", err, name)
 	}
 
-	return &Client{Config: cfg, provider: provider}, nil
+	return &Client{Config: cfg, provider: provider, dir: acctDir}, nil
 }
 
 // Close releases resources held by the client.
 func (c *Client) Close() error {
+	var err error
 	if c.provider != nil {
-		return c.provider.Close()
+		err = c.provider.Close()
+	}
+	if c.outbox != nil {
+		if oerr := c.outbox.Close(); err == nil {
+			err = oerr
+		}
 	}
-	return nil
+	return err
 }
 
 // Listen long-polls for incoming messages, returning a channel of IncomingMessage.
 // The channel is closed when ctx is cancelled.
-func (c *Client) Listen(ctx context.Context) (<-chan IncomingMessage, error) {
-	return c.provider.Listen(ctx)
+func (c *Client) Listen(ctx context.Context, opts ListenOptions) (<-chan IncomingMessage, error) {
+	return c.provider.Listen(ctx, opts)
 }
 
-// Send sends a text message to a room.
-func (c *Client) Send(ctx context.Context, roomID string, text string) error {
-	return c.provider.Send(ctx, roomID, text)
+// ListenErr returns the error that stopped Listen, once its channel has been
+// closed. It is nil if Listen stopped because ctx was cancelled.
+func (c *Client) ListenErr() error {
+	return c.provider.ListenErr()
+}
+
+// Checkpoint records that msg, received from Listen, has been handled. Call it
+// for every message once it has been written out; a later Listen with
+// ListenOptions.Resume then continues after the last handled message,
+// without emitting any handled message again.
+func (c *Client) Checkpoint(ctx context.Context, msg *IncomingMessage) error {
+	return c.provider.Checkpoint(ctx, msg)
+}
+
+// Send sends a message to a room and returns the created event. The RoomID
+// and UserID fields of msg are ignored; use FindOrCreateDM to resolve a user
+// to a room first. Failures that may go away on retry are returned as a
+// *TemporaryError.
+func (c *Client) Send(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error) {
+	return c.provider.Send(ctx, roomID, msg)
 }
 
 // FindOrCreateDM returns the room ID for a direct message with the given user,
@@ -115,3 +316,65 @@ func (c *Client) FindOrCreateDM(ctx context.Context, userID string) (string, err
 func (c *Client) ListRooms(ctx context.Context) ([]Room, error) {
 	return c.provider.ListRooms(ctx)
 }
+
+// Download fetches an attachment by mxc:// URL, or by the event ID of a media
+// message in roomID. Encrypted attachments are decrypted; they can only be
+// downloaded by event ID since the key is part of the event.
+func (c *Client) Download(ctx context.Context, roomID string, ref string) ([]byte, *Attachment, error) {
+	return c.provider.Download(ctx, roomID, ref)
+}
+
+// History returns past messages in a room in chronological order, paging
+// backwards from the most recent message (or opts.Before) until one of the
+// bounds in opts is reached. Encrypted messages are decrypted where possible.
+func (c *Client) History(ctx context.Context, roomID string, opts HistoryOptions) ([]IncomingMessage, error) {
+	return c.provider.History(ctx, roomID, opts)
+}
+
+// Devices lists the account's logged-in sessions, most recently used first.
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	return c.provider.Devices(ctx)
+}
+
+// RenameDevice sets the display name of one of the account's devices.
+func (c *Client) RenameDevice(ctx context.Context, deviceID, name string) error {
+	return c.provider.RenameDevice(ctx, deviceID, name)
+}
+
+// DeleteDevice logs out another of the account's devices. password is called
+// if the homeserver asks for the account password to confirm.
+func (c *Client) DeleteDevice(ctx context.Context, deviceID string, password func() (string, error)) error {
+	return c.provider.DeleteDevice(ctx, deviceID, password)
+}
+
+// Verify runs an interactive device verification with another device or
+// user, and returns nil once both sides have confirmed it.
+func (c *Client) Verify(ctx context.Context, opts VerifyOptions) error {
+	return c.provider.Verify(ctx, opts)
+}
+
+// BootstrapCrossSigning sets up cross-signing for the account and returns
+// the new recovery key, which unlocks the keys from other devices. password
+// is called if the homeserver asks for the account password to confirm.
+func (c *Client) BootstrapCrossSigning(ctx context.Context, password func() (string, error), replace bool) (string, error) {
+	return c.provider.BootstrapCrossSigning(ctx, password, replace)
+}
+
+// RecoverCrossSigning makes this device trusted by the account's other
+// sessions, using the recovery key or passphrase from BootstrapCrossSigning.
+func (c *Client) RecoverCrossSigning(ctx context.Context, secret string) error {
+	return c.provider.RecoverCrossSigning(ctx, secret)
+}
+
+// RestoreKeyBackup imports the room keys from the account's online key
+// backup, unlocked with the recovery key or passphrase, and returns how many
+// were imported. It returns ErrNoKeyBackup if the account has no backup.
+func (c *Client) RestoreKeyBackup(ctx context.Context, secret string) (int, error) {
+	return c.provider.RestoreKeyBackup(ctx, secret)
+}
+
+// BackupRoomKeys uploads room keys that aren't in the key backup yet and
+// returns how many were uploaded. Listen does this periodically by itself.
+func (c *Client) BackupRoomKeys(ctx context.Context) (int, error) {
+	return c.provider.BackupRoomKeys(ctx)
+}
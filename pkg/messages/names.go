@@ -0,0 +1,259 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// nameCache caches resolved display names so Listen doesn't hit the state
+// store or the homeserver for every message. Entries are invalidated from the
+// sync stream when the underlying state changes.
+type nameCache struct {
+	mu      sync.Mutex
+	members map[id.RoomID]map[id.UserID]string
+	rooms   map[id.RoomID]string
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{
+		members: make(map[id.RoomID]map[id.UserID]string),
+		rooms:   make(map[id.RoomID]string),
+	}
+}
+
+func (c *nameCache) room(roomID id.RoomID) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.rooms[roomID]
+	return name, ok
+}
+
+func (c *nameCache) setRoom(roomID id.RoomID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rooms[roomID] = name
+}
+
+func (c *nameCache) invalidateRoom(roomID id.RoomID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rooms, roomID)
+}
+
+func (c *nameCache) member(roomID id.RoomID, userID id.UserID) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.members[roomID][userID]
+	return name, ok
+}
+
+func (c *nameCache) setMember(roomID id.RoomID, userID id.UserID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.members[roomID] == nil {
+		c.members[roomID] = make(map[id.UserID]string)
+	}
+	c.members[roomID][userID] = name
+}
+
+func (c *nameCache) invalidateMember(roomID id.RoomID, userID id.UserID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.members[roomID], userID)
+}
+
+// handleMemberEvent drops cached names for members whose state changed. The
+// state store is updated by a global sync handler, which runs before this one.
+// Membership changes also affect the computed name of unnamed rooms.
+func (p *MatrixProvider) handleMemberEvent(ctx context.Context, evt *event.Event) {
+	p.names.invalidateMember(evt.RoomID, id.UserID(evt.GetStateKey()))
+	p.names.invalidateRoom(evt.RoomID)
+}
+
+// handleRoomNameEvent stores m.room.name and m.room.canonical_alias changes
+// and drops the cached room display name.
+func (p *MatrixProvider) handleRoomNameEvent(ctx context.Context, evt *event.Event) {
+	var err error
+	switch content := evt.Content.Parsed.(type) {
+	case *event.RoomNameEventContent:
+		err = p.syncStore.SetRoomName(ctx, evt.RoomID, content.Name)
+	case *event.CanonicalAliasEventContent:
+		err = p.syncStore.SetCanonicalAlias(ctx, evt.RoomID, content.Alias)
+	}
+	if err != nil {
+		slog.Warn("failed to store room name state", "room_id", evt.RoomID, "type", evt.Type.Type, "error", err)
+	}
+	p.names.invalidateRoom(evt.RoomID)
+}
+
+// handleRoomSummaries is a sync handler that stores the room summaries of a
+// sync response and drops the cached display names of the rooms they changed.
+func (p *MatrixProvider) handleRoomSummaries(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+	for roomID, room := range resp.Rooms.Join {
+		summary := room.Summary
+		if summary.Heroes == nil && summary.JoinedMemberCount == nil && summary.InvitedMemberCount == nil {
+			continue
+		}
+		if err := p.syncStore.SetRoomSummary(ctx, roomID, &summary); err != nil {
+			slog.Warn("failed to store room summary", "room_id", roomID, "error", err)
+		}
+		p.names.invalidateRoom(roomID)
+	}
+	return true
+}
+
+// getRoomDisplayName returns the display name of a room, computed from the
+// synced room state as described in the spec: the room name, then the
+// canonical alias, then the names of the room's heroes or other members.
+func (p *MatrixProvider) getRoomDisplayName(ctx context.Context, roomID id.RoomID) string {
+	if name, ok := p.names.room(roomID); ok {
+		return name
+	}
+	name, err := p.computeRoomName(ctx, roomID)
+	if err != nil {
+		slog.Debug("failed to compute room name", "room_id", roomID, "error", err)
+		name = string(roomID)
+	}
+	p.names.setRoom(roomID, name)
+	return name
+}
+
+func (p *MatrixProvider) computeRoomName(ctx context.Context, roomID id.RoomID) (string, error) {
+	name, alias, found, err := p.syncStore.GetRoomNameState(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		// The sync stream only carries name state when it changes, so a
+		// sync store from before room names were stored lacks it. Fetch it
+		// once from the homeserver.
+		if name, alias, err = p.fetchRoomNameState(ctx, roomID); err != nil {
+			return "", err
+		}
+		if err := p.syncStore.InitRoomNameState(ctx, roomID, name, alias); err != nil {
+			slog.Warn("failed to store room name state", "room_id", roomID, "error", err)
+		}
+	}
+	if name != "" {
+		return name, nil
+	}
+	if alias != "" {
+		return string(alias), nil
+	}
+
+	summary, err := p.syncStore.GetRoomSummary(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	if summary != nil && len(summary.Heroes) > 0 {
+		heroes := make([]string, 0, maxHeroes)
+		for _, userID := range summary.Heroes[:min(len(summary.Heroes), maxHeroes)] {
+			heroes = append(heroes, p.memberName(ctx, roomID, userID))
+		}
+		others := len(summary.Heroes)
+		if summary.JoinedMemberCount != nil && summary.InvitedMemberCount != nil {
+			others = max(others, *summary.JoinedMemberCount+*summary.InvitedMemberCount-1)
+		}
+		return roomNameFromHeroes(heroes, others), nil
+	}
+
+	// Without a summary, the heroes are the first other members by user ID.
+	members, err := p.syncStore.state.GetRoomMembers(ctx, roomID, event.MembershipJoin, event.MembershipInvite)
+	if err != nil {
+		return "", err
+	}
+	others := make([]id.UserID, 0, len(members))
+	for userID := range members {
+		if userID != p.userID {
+			others = append(others, userID)
+		}
+	}
+	slices.Sort(others)
+	heroes := make([]string, 0, maxHeroes)
+	for _, userID := range others[:min(len(others), maxHeroes)] {
+		if dn := members[userID].Displayname; dn != "" {
+			heroes = append(heroes, dn)
+		} else {
+			heroes = append(heroes, string(userID))
+		}
+	}
+	return roomNameFromHeroes(heroes, len(others)), nil
+}
+
+// memberName returns the display name of a room member from the state
+// store, or their user ID if it has none.
+func (p *MatrixProvider) memberName(ctx context.Context, roomID id.RoomID, userID id.UserID) string {
+	member, err := p.syncStore.state.TryGetMember(ctx, roomID, userID)
+	if err != nil {
+		slog.Debug("failed to get member from state store", "room_id", roomID, "user_id", userID, "error", err)
+	}
+	if member != nil && member.Displayname != "" {
+		return member.Displayname
+	}
+	return string(userID)
+}
+
+// fetchRoomNameState looks up the room name and canonical alias on the
+// homeserver. Either is empty if the room doesn't have one.
+func (p *MatrixProvider) fetchRoomNameState(ctx context.Context, roomID id.RoomID) (string, id.RoomAlias, error) {
+	var nameContent event.RoomNameEventContent
+	err := p.client.StateEvent(ctx, roomID, event.StateRoomName, "", &nameContent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return "", "", fmt.Errorf("failed to fetch room name: %w", err)
+	}
+	var aliasContent event.CanonicalAliasEventContent
+	err = p.client.StateEvent(ctx, roomID, event.StateCanonicalAlias, "", &aliasContent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return "", "", fmt.Errorf("failed to fetch room canonical alias: %w", err)
+	}
+	return nameContent.Name, aliasContent.Alias, nil
+}
+
+// maxHeroes is the number of members used to name an unnamed room.
+const maxHeroes = 5
+
+// roomNameFromHeroes computes the name of an unnamed room from the display
+// names of up to maxHeroes other members and the total number of other
+// joined or invited members.
+func roomNameFromHeroes(heroes []string, otherMembers int) string {
+	switch {
+	case len(heroes) == 0:
+		return "Empty Room"
+	case otherMembers > len(heroes):
+		return fmt.Sprintf("%s and %d others", strings.Join(heroes, ", "), otherMembers-len(heroes))
+	case len(heroes) == 1:
+		return heroes[0]
+	default:
+		return fmt.Sprintf("%s and %s", strings.Join(heroes[:len(heroes)-1], ", "), heroes[len(heroes)-1])
+	}
+}
+
+// getSenderName returns the display name of a room member, resolved from the
+// room's m.room.member state and falling back to the global profile and
+// finally the raw user ID.
+func (p *MatrixProvider) getSenderName(ctx context.Context, roomID id.RoomID, userID id.UserID) string {
+	if name, ok := p.names.member(roomID, userID); ok {
+		return name
+	}
+	name := string(userID)
+	member, err := p.syncStore.state.TryGetMember(ctx, roomID, userID)
+	if err != nil {
+		slog.Debug("failed to get member from state store", "room_id", roomID, "user_id", userID, "error", err)
+	}
+	if member != nil && member.Displayname != "" {
+		name = member.Displayname
+	} else if resp, err := p.client.GetDisplayName(ctx, userID); err == nil && resp.DisplayName != "" {
+		name = resp.DisplayName
+	}
+	p.names.setMember(roomID, userID, name)
+	return name
+}
@@ -0,0 +1,160 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomNameFromHeroes(t *testing.T) {
+	tests := []struct {
+		heroes []string
+		others int
+		want   string
+	}{
+		{nil, 0, "Empty Room"},
+		{[]string{"Alice"}, 1, "Alice"},
+		{[]string{"Alice", "Bob"}, 2, "Alice and Bob"},
+		{[]string{"Alice", "Bob", "Carol"}, 3, "Alice, Bob and Carol"},
+		{[]string{"Alice", "Bob"}, 7, "Alice, Bob and 5 others"},
+	}
+	for _, tt := range tests {
+		if got := roomNameFromHeroes(tt.heroes, tt.others); got != tt.want {
+			t.Errorf("roomNameFromHeroes(%v, %d): got %q, want %q", tt.heroes, tt.others, got, tt.want)
+		}
+	}
+}
+
+func TestNameCache_Invalidate(t *testing.T) {
+	c := newNameCache()
+	c.setMember("!room:example.org", "@bob:example.org", "Bob")
+	c.setRoom("!room:example.org", "General")
+
+	if name, ok := c.member("!room:example.org", "@bob:example.org"); !ok || name != "Bob" {
+		t.Errorf("member: got %q/%v, want Bob/true", name, ok)
+	}
+	c.invalidateMember("!room:example.org", "@bob:example.org")
+	if _, ok := c.member("!room:example.org", "@bob:example.org"); ok {
+		t.Error("member should be invalidated")
+	}
+
+	if name, ok := c.room("!room:example.org"); !ok || name != "General" {
+		t.Errorf("room: got %q/%v, want General/true", name, ok)
+	}
+	c.invalidateRoom("!room:example.org")
+	if _, ok := c.room("!room:example.org"); ok {
+		t.Error("room should be invalidated")
+	}
+}
+
+func newTestNameProvider(t *testing.T, handler http.HandlerFunc) *MatrixProvider {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	client, err := mautrix.NewClient(srv.URL, "@bot:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MatrixProvider{client: client, syncStore: newTestSyncStore(t), names: newNameCache(), userID: "@bot:example.org"}
+}
+
+func TestComputeRoomName_Heroes(t *testing.T) {
+	p := newTestNameProvider(t, http.NotFound)
+	ctx := context.Background()
+	room := id.RoomID("!room:example.org")
+
+	if err := p.syncStore.InitRoomNameState(ctx, room, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	joined, invited := 8, 0
+	resp := &mautrix.RespSync{}
+	resp.Rooms.Join = map[id.RoomID]*mautrix.SyncJoinedRoom{room: {
+		Summary: mautrix.LazyLoadSummary{
+			Heroes:             []id.UserID{"@alice:example.org", "@bob:example.org"},
+			JoinedMemberCount:  &joined,
+			InvitedMemberCount: &invited,
+		},
+	}}
+	p.handleRoomSummaries(ctx, resp, "s1")
+
+	if got, want := p.getRoomDisplayName(ctx, room), "@alice:example.org, @bob:example.org and 5 others"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestComputeRoomName_FetchesMissingState(t *testing.T) {
+	var fetches int
+	p := newTestNameProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:example.org/state/m.room.name/":
+			json.NewEncoder(w).Encode(map[string]string{"name": "General"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_NOT_FOUND", "error": "Event not found"})
+		}
+	})
+	ctx := context.Background()
+	room := id.RoomID("!room:example.org")
+
+	if got := p.getRoomDisplayName(ctx, room); got != "General" {
+		t.Errorf("got %q, want General", got)
+	}
+	p.names.invalidateRoom(room)
+	if got := p.getRoomDisplayName(ctx, room); got != "General" {
+		t.Errorf("got %q from the sync store, want General", got)
+	}
+	if fetches != 2 {
+		t.Errorf("made %d requests, want 2", fetches)
+	}
+}
+
+func TestGetSenderName_Fallbacks(t *testing.T) {
+	var lookups []string
+	p := newTestNameProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups = append(lookups, r.URL.Path)
+		switch r.URL.Path {
+		case "/_matrix/client/v3/profile/@bob:example.org/displayname":
+			json.NewEncoder(w).Encode(map[string]string{"displayname": "Bob"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"errcode": "M_NOT_FOUND", "error": "Profile not found"})
+		}
+	})
+	ctx := context.Background()
+	room := id.RoomID("!room:example.org")
+	err := p.syncStore.state.SetMember(ctx, room, "@alice:example.org", &event.MemberEventContent{
+		Membership:  event.MembershipJoin,
+		Displayname: "Alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userID id.UserID
+		want   string
+	}{
+		{"@alice:example.org", "Alice"},              // member state
+		{"@bob:example.org", "Bob"},                  // global profile
+		{"@carol:example.org", "@carol:example.org"}, // neither: the user ID
+	}
+	for _, tt := range tests {
+		if got := p.getSenderName(ctx, room, tt.userID); got != tt.want {
+			t.Errorf("getSenderName(%s): got %q, want %q", tt.userID, got, tt.want)
+		}
+	}
+	if len(lookups) != 2 {
+		t.Errorf("made profile requests %v, want one each for bob and carol", lookups)
+	}
+	// The fallback is cached too, so the profile isn't fetched again.
+	if got := p.getSenderName(ctx, room, "@carol:example.org"); got != "@carol:example.org" || len(lookups) != 2 {
+		t.Errorf("got %q after %d requests, want the cached user ID", got, len(lookups))
+	}
+}
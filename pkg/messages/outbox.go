@@ -0,0 +1,472 @@
+package messages
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+)
+
+// Outbox retry policy: the delay doubles from outboxBaseDelay up to
+// outboxMaxDelay, and a message is dead-lettered after outboxMaxAttempts.
+const (
+	outboxBaseDelay   = time.Second
+	outboxMaxDelay    = 5 * time.Minute
+	outboxMaxAttempts = 10
+)
+
+// TemporaryError is returned by Send when sending failed for a reason that may
+// go away, such as a network error, a homeserver error or rate limiting.
+// RateLimited is set when the homeserver rate limited the request, and
+// RetryAfter is the delay it asked for, if any.
+type TemporaryError struct {
+	Err         error
+	RateLimited bool
+	RetryAfter  time.Duration
+}
+
+func (e *TemporaryError) Error() string { return e.Err.Error() }
+func (e *TemporaryError) Unwrap() error { return e.Err }
+
+// OutboxEntry is a message waiting in the outbox, or one that exhausted its
+// retries and was dead-lettered (Status is "pending" or "dead").
+type OutboxEntry struct {
+	ID          int64           `json:"id,omitempty"`
+	Status      string          `json:"status"`
+	RoomID      string          `json:"room_id"`
+	Message     OutgoingMessage `json:"message"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	NextAttempt string          `json:"next_attempt,omitempty"`
+	FailedAt    string          `json:"failed_at,omitempty"`
+}
+
+// Outbox entry statuses.
+const (
+	OutboxPending = "pending"
+	OutboxDead    = "dead"
+)
+
+// outbox persists messages that failed to send in a SQLite database in the
+// account directory, so they survive until they are sent or dead-lettered.
+// Dead letters are appended to a JSON lines file next to it.
+type outbox struct {
+	db             *dbutil.Database
+	deadLetterPath string
+}
+
+func newOutbox(dir string) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create account directory: %w", err)
+	}
+	path := filepath.Join(dir, "outbox.db")
+	db, err := dbutil.NewWithDialect(fmt.Sprintf("file:%s?_txlock=immediate", path), "sqlite3-fk-wal")
+	if err != nil {
+		return nil, err
+	}
+	return &outbox{db: db, deadLetterPath: filepath.Join(dir, "dead_letter.jsonl")}, nil
+}
+
+// Upgrade creates the outbox table.
+func (o *outbox) Upgrade(ctx context.Context) error {
+	_, err := o.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS outbox (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id      TEXT NOT NULL,
+			message      TEXT NOT NULL,
+			attempts     INTEGER NOT NULL DEFAULT 0,
+			last_error   TEXT NOT NULL DEFAULT '',
+			next_attempt BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox table: %w", err)
+	}
+	return nil
+}
+
+// Enqueue adds a message to the outbox, to be attempted at next.
+func (o *outbox) Enqueue(ctx context.Context, roomID string, msg *OutgoingMessage, attempts int, lastError string, next time.Time) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	_, err = o.db.Exec(ctx, `
+		INSERT INTO outbox (room_id, message, attempts, last_error, next_attempt) VALUES ($1, $2, $3, $4, $5)`,
+		roomID, string(data), attempts, lastError, next.UnixMilli())
+	return err
+}
+
+// HasPending reports whether the outbox holds messages for roomID.
+func (o *outbox) HasPending(ctx context.Context, roomID string) (bool, error) {
+	var exists bool
+	err := o.db.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM outbox WHERE room_id=$1)`, roomID).Scan(&exists)
+	return exists, err
+}
+
+// Next returns the entry to attempt next: of the oldest entry in each room,
+// the one that is due first. Later entries for a room wait for earlier ones,
+// so per-room ordering is kept. It returns nil if the outbox is empty.
+func (o *outbox) Next(ctx context.Context) (*OutboxEntry, error) {
+	row := o.db.QueryRow(ctx, `
+		SELECT id, room_id, message, attempts, last_error, next_attempt FROM outbox
+		WHERE id IN (SELECT MIN(id) FROM outbox GROUP BY room_id)
+		ORDER BY next_attempt, id LIMIT 1`)
+	entry, err := scanOutboxEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return entry, err
+}
+
+// List returns all pending entries, oldest first.
+func (o *outbox) List(ctx context.Context) ([]OutboxEntry, error) {
+	rows, err := o.db.Query(ctx, `SELECT id, room_id, message, attempts, last_error, next_attempt FROM outbox ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []OutboxEntry
+	for rows.Next() {
+		entry, err := scanOutboxEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, rows.Err()
+}
+
+func scanOutboxEntry(row dbutil.Scannable) (*OutboxEntry, error) {
+	var entry OutboxEntry
+	var data string
+	var next int64
+	if err := row.Scan(&entry.ID, &entry.RoomID, &data, &entry.Attempts, &entry.LastError, &next); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(data), &entry.Message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal outbox message %d: %w", entry.ID, err)
+	}
+	entry.Status = OutboxPending
+	entry.NextAttempt = time.UnixMilli(next).UTC().Format(time.RFC3339)
+	return &entry, nil
+}
+
+// Reschedule records a failed attempt of an entry.
+func (o *outbox) Reschedule(ctx context.Context, id int64, attempts int, lastError string, next time.Time) error {
+	_, err := o.db.Exec(ctx, `UPDATE outbox SET attempts=$2, last_error=$3, next_attempt=$4 WHERE id=$1`,
+		id, attempts, lastError, next.UnixMilli())
+	return err
+}
+
+func (o *outbox) Delete(ctx context.Context, id int64) error {
+	_, err := o.db.Exec(ctx, `DELETE FROM outbox WHERE id=$1`, id)
+	return err
+}
+
+// Purge deletes all pending entries and returns how many there were.
+func (o *outbox) Purge(ctx context.Context) (int64, error) {
+	res, err := o.db.Exec(ctx, `DELETE FROM outbox`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeadLetter moves an entry from the outbox to the dead-letter file.
+func (o *outbox) DeadLetter(ctx context.Context, entry *OutboxEntry) error {
+	dead := *entry
+	dead.ID = 0
+	dead.Status = OutboxDead
+	dead.NextAttempt = ""
+	dead.FailedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(dead)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	f, err := os.OpenFile(o.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return o.Delete(ctx, entry.ID)
+}
+
+// DeadLetters returns the entries in the dead-letter file.
+func (o *outbox) DeadLetters() ([]OutboxEntry, error) {
+	f, err := os.Open(o.deadLetterPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	defer f.Close()
+	var entries []OutboxEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry OutboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid dead letter: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// PurgeDeadLetters removes the dead-letter file.
+func (o *outbox) PurgeDeadLetters() error {
+	if err := os.Remove(o.deadLetterPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove dead-letter file: %w", err)
+	}
+	return nil
+}
+
+func (o *outbox) Close() error {
+	return o.db.Close()
+}
+
+// retryDelay returns how long to wait before the next attempt after the
+// given number of failed attempts.
+func retryDelay(attempts int, err error) time.Duration {
+	delay := outboxBaseDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, outboxMaxDelay)
+	var temp *TemporaryError
+	if errors.As(err, &temp) && temp.RetryAfter > delay {
+		delay = temp.RetryAfter
+	}
+	return delay
+}
+
+// newTxnID returns a random transaction ID for an outbox message, so retries
+// of a message the homeserver did receive aren't posted twice.
+func newTxnID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "messages-outbox-" + hex.EncodeToString(b)
+}
+
+// getOutbox opens the account's outbox on first use.
+func (c *Client) getOutbox(ctx context.Context) (*outbox, error) {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	if c.outbox != nil {
+		return c.outbox, nil
+	}
+	ob, err := newOutbox(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+	if err := ob.Upgrade(ctx); err != nil {
+		ob.Close()
+		return nil, fmt.Errorf("failed to upgrade outbox: %w", err)
+	}
+	c.outbox = ob
+	return ob, nil
+}
+
+// SendOrQueue sends a message like Send, but stores it in the outbox instead
+// of dropping it if sending fails with a TemporaryError. Messages for a room
+// that already has messages in the outbox are queued behind them to keep
+// their order. queued reports whether msg was stored; err is then the error
+// of the failed attempt, if there was one. Queued messages are sent by
+// FlushOutbox. A msg without a TxnID is given one, which identifies it in the
+// outbox and in the results FlushOutbox reports.
+func (c *Client) SendOrQueue(ctx context.Context, roomID string, msg *OutgoingMessage) (result *SendResult, queued bool, err error) {
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	// The transaction ID is set before the first attempt, so a retry of an
+	// attempt the homeserver did accept isn't posted twice.
+	if msg.TxnID == "" {
+		msg.TxnID = newTxnID()
+	}
+	pending, err := ob.HasPending(ctx, roomID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check outbox: %w", err)
+	}
+	if pending {
+		slog.Debug("room has queued messages, queueing message", "room_id", roomID)
+		if err := c.enqueue(ctx, ob, roomID, msg, 0, nil); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	result, err = c.Send(ctx, roomID, msg)
+	var temp *TemporaryError
+	if err == nil || !errors.As(err, &temp) {
+		return result, false, err
+	}
+	slog.Debug("send failed temporarily, queueing message", "room_id", roomID, "error", err)
+	if qerr := c.enqueue(ctx, ob, roomID, msg, 1, err); qerr != nil {
+		return nil, false, errors.Join(err, qerr)
+	}
+	return nil, true, err
+}
+
+func (c *Client) enqueue(ctx context.Context, ob *outbox, roomID string, msg *OutgoingMessage, attempts int, cause error) error {
+	queued := *msg
+	if queued.TxnID == "" {
+		queued.TxnID = newTxnID()
+	}
+	next := time.Now()
+	var lastError string
+	if cause != nil {
+		next = next.Add(retryDelay(attempts, cause))
+		lastError = cause.Error()
+	}
+	if err := ob.Enqueue(ctx, roomID, &queued, attempts, lastError, next); err != nil {
+		return fmt.Errorf("failed to queue message: %w", err)
+	}
+	return nil
+}
+
+// FlushOutbox sends the messages in the outbox, waiting between attempts
+// with exponential backoff (or as long as the homeserver asks when rate
+// limited), until the outbox is empty or ctx is cancelled. Messages that fail
+// permanently or exhaust their retries are moved to the dead-letter file. If
+// the account has to log in again, it stops and returns ErrReauthRequired,
+// leaving the messages queued.
+// done is called with the outcome of each message that leaves the outbox.
+func (c *Client) FlushOutbox(ctx context.Context, done func(entry *OutboxEntry, result *SendResult, err error)) error {
+	return c.flushOutbox(ctx, c.Send, done)
+}
+
+// flushOutbox implements FlushOutbox, sending each message with send.
+func (c *Client) flushOutbox(ctx context.Context, send func(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error), done func(entry *OutboxEntry, result *SendResult, err error)) error {
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		entry, err := ob.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read outbox: %w", err)
+		} else if entry == nil {
+			return nil
+		}
+		next, _ := time.Parse(time.RFC3339, entry.NextAttempt)
+		if wait := time.Until(next); wait > 0 {
+			slog.Debug("waiting for next outbox attempt", "room_id", entry.RoomID, "wait", wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		result, sendErr := send(ctx, entry.RoomID, &entry.Message)
+		if sendErr == nil {
+			if err := ob.Delete(ctx, entry.ID); err != nil {
+				return fmt.Errorf("failed to remove sent message from outbox: %w", err)
+			}
+			done(entry, result, nil)
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(sendErr, ErrReauthRequired) {
+			// Every other message would fail the same way; keep them all
+			// queued for when the account has logged in again.
+			return sendErr
+		}
+		entry.Attempts++
+		entry.LastError = sendErr.Error()
+		var temp *TemporaryError
+		if !errors.As(sendErr, &temp) || entry.Attempts >= outboxMaxAttempts {
+			slog.Debug("dead-lettering message", "room_id", entry.RoomID, "attempts", entry.Attempts, "error", sendErr)
+			if err := ob.DeadLetter(ctx, entry); err != nil {
+				return err
+			}
+			done(entry, nil, sendErr)
+			continue
+		}
+		delay := retryDelay(entry.Attempts, sendErr)
+		slog.Debug("send failed, retrying later", "room_id", entry.RoomID, "attempts", entry.Attempts, "delay", delay, "error", sendErr)
+		if err := ob.Reschedule(ctx, entry.ID, entry.Attempts, entry.LastError, time.Now().Add(delay)); err != nil {
+			return fmt.Errorf("failed to update outbox: %w", err)
+		}
+	}
+}
+
+// Outbox returns the messages waiting in the outbox followed by the
+// dead-lettered ones.
+func (c *Client) Outbox(ctx context.Context) ([]OutboxEntry, error) {
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := ob.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox: %w", err)
+	}
+	dead, err := ob.DeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	return append(pending, dead...), nil
+}
+
+// RetryDeadLetters moves the dead-lettered messages back into the outbox with
+// a fresh retry budget, to be sent by the next FlushOutbox. It returns how
+// many were requeued.
+func (c *Client) RetryDeadLetters(ctx context.Context) (int, error) {
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		return 0, err
+	}
+	dead, err := ob.DeadLetters()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range dead {
+		if err := c.enqueue(ctx, ob, entry.RoomID, &entry.Message, 0, nil); err != nil {
+			return 0, err
+		}
+	}
+	if err := ob.PurgeDeadLetters(); err != nil {
+		return 0, err
+	}
+	return len(dead), nil
+}
+
+// PurgeOutbox drops all queued and dead-lettered messages and returns how
+// many were dropped.
+func (c *Client) PurgeOutbox(ctx context.Context) (int, error) {
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		return 0, err
+	}
+	dead, err := ob.DeadLetters()
+	if err != nil {
+		return 0, err
+	}
+	n, err := ob.Purge(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge outbox: %w", err)
+	}
+	if err := ob.PurgeDeadLetters(); err != nil {
+		return 0, err
+	}
+	return int(n) + len(dead), nil
+}
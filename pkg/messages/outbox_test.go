@@ -0,0 +1,197 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// fakeProvider fails the given number of sends with err, then succeeds.
+type fakeProvider struct {
+	Provider
+	mu       sync.Mutex
+	failures int
+	err      error
+	sent     []string
+	txnIDs   []string // of every attempt
+}
+
+func (p *fakeProvider) Send(ctx context.Context, roomID string, msg *OutgoingMessage) (*SendResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.txnIDs = append(p.txnIDs, msg.TxnID)
+	if p.failures > 0 {
+		p.failures--
+		return nil, p.err
+	}
+	p.sent = append(p.sent, msg.Text)
+	return &SendResult{RoomID: roomID, EventID: "$" + msg.Text}, nil
+}
+
+func (p *fakeProvider) Close() error { return nil }
+
+func newTestClient(t *testing.T, p *fakeProvider) *Client {
+	t.Helper()
+	c := &Client{provider: p, dir: t.TempDir()}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestOutbox_KeepsRoomOrder(t *testing.T) {
+	p := &fakeProvider{failures: 1, err: &TemporaryError{Err: errors.New("unavailable")}}
+	c := newTestClient(t, p)
+	ctx := context.Background()
+
+	first := &OutgoingMessage{Text: "first"}
+	_, queued, err := c.SendOrQueue(ctx, "!a:example.org", first)
+	if !queued || err == nil {
+		t.Fatalf("got queued=%v err=%v, want the failed message queued", queued, err)
+	}
+	// The room has a queued message, so this one must wait behind it.
+	_, queued, err = c.SendOrQueue(ctx, "!a:example.org", &OutgoingMessage{Text: "second"})
+	if !queued || err != nil {
+		t.Fatalf("got queued=%v err=%v, want the message queued behind the first", queued, err)
+	}
+	if len(p.sent) != 0 {
+		t.Fatalf("sent %v before the outbox was flushed", p.sent)
+	}
+
+	var done []string
+	err = c.FlushOutbox(ctx, func(entry *OutboxEntry, result *SendResult, err error) {
+		if err != nil {
+			t.Errorf("message %q failed: %v", entry.Message.Text, err)
+		}
+		if entry.Message.TxnID == "" {
+			t.Errorf("message %q was queued without a transaction ID", entry.Message.Text)
+		}
+		if entry.Message.Text == "first" && entry.Message.TxnID != first.TxnID {
+			t.Errorf("flushed with transaction ID %q, want %q as reported when queued", entry.Message.TxnID, first.TxnID)
+		}
+		done = append(done, entry.Message.Text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.sent) != 2 || p.sent[0] != "first" || p.sent[1] != "second" {
+		t.Errorf("sent %v, want [first second]", p.sent)
+	}
+	if len(done) != 2 {
+		t.Errorf("reported %v, want both messages", done)
+	}
+	// The retry of the first message reuses the failed attempt's transaction.
+	if len(p.txnIDs) != 3 || p.txnIDs[0] == "" || p.txnIDs[0] != p.txnIDs[1] {
+		t.Errorf("transaction IDs of attempts: %v, want the first two equal", p.txnIDs)
+	}
+}
+
+func TestOutbox_DeadLetter(t *testing.T) {
+	p := &fakeProvider{failures: 1, err: errors.New("forbidden")}
+	c := newTestClient(t, p)
+	ctx := context.Background()
+
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Enqueue(ctx, "!a:example.org", &OutgoingMessage{Text: "hi"}, 0, "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FlushOutbox(ctx, func(*OutboxEntry, *SendResult, error) {}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.Outbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Status != OutboxDead || entries[0].LastError != "forbidden" {
+		t.Fatalf("got %+v, want one dead letter", entries)
+	}
+
+	n, err := c.RetryDeadLetters(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("requeued %d (%v), want 1", n, err)
+	}
+	if err := c.FlushOutbox(ctx, func(*OutboxEntry, *SendResult, error) {}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.sent) != 1 {
+		t.Errorf("sent %v after retry, want the dead letter", p.sent)
+	}
+	if entries, _ := c.Outbox(ctx); len(entries) != 0 {
+		t.Errorf("outbox not empty after retry: %+v", entries)
+	}
+}
+
+func TestOutbox_StopsOnReauth(t *testing.T) {
+	p := &fakeProvider{failures: 100, err: ErrReauthRequired}
+	c := newTestClient(t, p)
+	ctx := context.Background()
+
+	ob, err := c.getOutbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"one", "two"} {
+		if err := ob.Enqueue(ctx, "!a:example.org", &OutgoingMessage{Text: text}, 0, "", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.FlushOutbox(ctx, func(entry *OutboxEntry, _ *SendResult, err error) {
+		t.Errorf("message %q left the outbox: %v", entry.Message.Text, err)
+	})
+	if !errors.Is(err, ErrReauthRequired) {
+		t.Fatalf("got %v, want ErrReauthRequired", err)
+	}
+	entries, err := c.Outbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Status == OutboxDead || entries[0].Attempts != 0 {
+		t.Errorf("got %+v, want both messages still queued", entries)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if d := retryDelay(1, errors.New("x")); d != time.Second {
+		t.Errorf("first retry: got %v, want 1s", d)
+	}
+	if d := retryDelay(4, errors.New("x")); d != 8*time.Second {
+		t.Errorf("fourth retry: got %v, want 8s", d)
+	}
+	if d := retryDelay(30, errors.New("x")); d != outboxMaxDelay {
+		t.Errorf("capped retry: got %v, want %v", d, outboxMaxDelay)
+	}
+	rateLimited := &TemporaryError{Err: errors.New("x"), RetryAfter: time.Minute}
+	if d := retryDelay(1, rateLimited); d != time.Minute {
+		t.Errorf("rate limited: got %v, want 1m", d)
+	}
+}
+
+func TestClassifySendError(t *testing.T) {
+	limited := mautrix.HTTPError{
+		Response: &http.Response{StatusCode: http.StatusTooManyRequests},
+		RespError: &mautrix.RespError{
+			ErrCode:   "M_LIMIT_EXCEEDED",
+			ExtraData: map[string]any{"retry_after_ms": float64(2500)},
+		},
+	}
+	var temp *TemporaryError
+	if !errors.As(classifySendError(limited), &temp) || temp.RetryAfter != 2500*time.Millisecond {
+		t.Errorf("429: got %v, want temporary error retrying after 2.5s", temp)
+	}
+
+	forbidden := mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusForbidden}}
+	if errors.As(classifySendError(forbidden), &temp) {
+		t.Error("403: got temporary error, want permanent")
+	}
+
+	noResponse := mautrix.HTTPError{WrappedError: errors.New("connection refused")}
+	if !errors.As(classifySendError(noResponse), &temp) {
+		t.Error("no response: got permanent error, want temporary")
+	}
+}
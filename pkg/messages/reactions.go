@@ -0,0 +1,54 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// sendReaction annotates the target event with key (usually an emoji).
+func (p *MatrixProvider) sendReaction(ctx context.Context, roomID id.RoomID, target id.EventID, key, txnID string) (*SendResult, error) {
+	if target == "" {
+		return nil, fmt.Errorf("reaction requires reacts_to (the event to react to)")
+	}
+	// The client sends reactions unencrypted even in encrypted rooms, so
+	// unlike messages they don't need a catch-up sync first.
+	slog.Debug("sending reaction", "room_id", roomID, "event_id", target, "key", key)
+	resp, err := p.client.SendMessageEvent(ctx, roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
+			EventID: target,
+			Key:     key,
+		},
+	}, mautrix.ReqSendEvent{TransactionID: txnID})
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("reaction sent successfully", "room_id", roomID, "event_id", resp.EventID)
+	return newSendResult(roomID, resp), nil
+}
+
+// toIncomingReaction converts an m.reaction event to an IncomingMessage of
+// type TypeReaction. It returns nil if evt is not an annotation.
+func (p *MatrixProvider) toIncomingReaction(ctx context.Context, evt *event.Event) *IncomingMessage {
+	content := evt.Content.AsReaction()
+	if content == nil || content.RelatesTo.Type != event.RelAnnotation {
+		return nil
+	}
+	return &IncomingMessage{
+		Type:       TypeReaction,
+		RoomID:     string(evt.RoomID),
+		RoomName:   p.getRoomDisplayName(ctx, evt.RoomID),
+		Sender:     string(evt.Sender),
+		SenderName: p.getSenderName(ctx, evt.RoomID, evt.Sender),
+		Reaction:   content.RelatesTo.Key,
+		ReactsTo:   string(content.RelatesTo.EventID),
+		Timestamp:  time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
+		EventID:    string(evt.ID),
+	}
+}
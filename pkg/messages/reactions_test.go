@@ -0,0 +1,42 @@
+package messages
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestSend_ReactionRequiresTarget(t *testing.T) {
+	p := &MatrixProvider{}
+	_, err := p.Send(context.Background(), "!room:example.org", &OutgoingMessage{Reaction: "👍"})
+	if err == nil || !strings.Contains(err.Error(), "reacts_to") {
+		t.Errorf("got %v, want error about reacts_to", err)
+	}
+}
+
+func TestToIncomingReaction(t *testing.T) {
+	p := newTestNameProvider(t, http.NotFound)
+	evt := &event.Event{
+		Type:   event.EventReaction,
+		ID:     "$reaction",
+		RoomID: "!room:example.org",
+		Sender: "@alice:example.org",
+		Content: event.Content{Parsed: &event.ReactionEventContent{RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
+			EventID: "$orig",
+			Key:     "👍",
+		}}},
+	}
+
+	msg := p.toIncomingReaction(context.Background(), evt)
+	if msg == nil || msg.Type != TypeReaction || msg.Reaction != "👍" || msg.ReactsTo != "$orig" {
+		t.Fatalf("got %+v, want a 👍 reaction to $orig", msg)
+	}
+	// Only replies set ReplyTo, so filtering on it doesn't match reactions.
+	if msg.ReplyTo != "" {
+		t.Errorf("got reply_to %q on a reaction, want it empty", msg.ReplyTo)
+	}
+}
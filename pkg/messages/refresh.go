@@ -0,0 +1,230 @@
+package messages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// refreshMargin is how long before it expires an access token is refreshed.
+const refreshMargin = time.Minute
+
+// tokenRefresher is an http.RoundTripper that keeps the access token of a
+// Matrix client valid. It refreshes the token shortly before it expires, or
+// when the homeserver rejects it with M_UNKNOWN_TOKEN, saves the new
+// credentials and retries the request with the new token. A rejected token
+// that can't be refreshed fails the request with ErrReauthRequired.
+//
+// The client's own AccessToken is never updated, since mautrix reads it
+// without locking; every request has its Authorization header replaced with
+// the current token instead.
+type tokenRefresher struct {
+	base   http.RoundTripper
+	client *mautrix.Client
+	load   func() (*MatrixCredentials, error)
+	save   func(*MatrixCredentials) error
+
+	mu    sync.Mutex
+	creds *MatrixCredentials
+}
+
+func newTokenRefresher(client *mautrix.Client, creds *MatrixCredentials, load func() (*MatrixCredentials, error), save func(*MatrixCredentials) error) *tokenRefresher {
+	base := client.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tokenRefresher{base: base, client: client, load: load, save: save, creds: creds}
+}
+
+func (t *tokenRefresher) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return t.base.RoundTrip(req)
+	}
+	token := t.currentToken(req.Context())
+	resp, err := t.base.RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Peek at the error, leaving the body for the caller to read.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var respErr mautrix.RespError
+	if json.Unmarshal(body, &respErr) != nil || respErr.ErrCode != mautrix.MUnknownToken.ErrCode {
+		return resp, nil
+	}
+
+	slog.Debug("access token rejected, refreshing", "url", req.URL.Path)
+	token, err = t.refresh(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// The body was used up and can't be sent again.
+		return resp, nil
+	}
+	retry := withToken(req, token)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// currentToken returns the access token to use, refreshing it first if it
+// is about to expire.
+func (t *tokenRefresher) currentToken(ctx context.Context) string {
+	t.mu.Lock()
+	token, stale := t.creds.AccessToken, expiring(t.creds)
+	t.mu.Unlock()
+	if !stale {
+		return token
+	}
+	newToken, err := t.refresh(ctx, token)
+	if err != nil {
+		// Try the old token; if it has expired, the request fails with
+		// M_UNKNOWN_TOKEN and the refresh is tried again.
+		slog.Warn("failed to refresh access token", "error", err)
+		return token
+	}
+	return newToken
+}
+
+// refresh exchanges the refresh token for a new access token, unless stale is
+// no longer the current access token because another request refreshed it.
+// If the homeserver rejects the refresh token, the saved credentials are
+// reloaded in case another process already used it and saved the new one.
+func (t *tokenRefresher) refresh(ctx context.Context, stale string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.creds.AccessToken != stale {
+		return t.creds.AccessToken, nil
+	}
+	for reloaded := false; ; reloaded = true {
+		if t.creds.RefreshToken == "" {
+			return "", ErrReauthRequired
+		}
+		resp, err := t.exchange(ctx, t.creds.RefreshToken)
+		if errors.Is(err, ErrReauthRequired) && !reloaded && t.reload() {
+			if t.creds.AccessToken != stale && !expiring(t.creds) {
+				return t.creds.AccessToken, nil
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		creds := *t.creds
+		creds.AccessToken = resp.AccessToken
+		if resp.RefreshToken != "" {
+			creds.RefreshToken = resp.RefreshToken
+		}
+		creds.ExpiresAt = expiresAt(resp.ExpiresInMS)
+		// Refresh tokens are single use, so the new one must be kept even if
+		// saving fails.
+		t.creds = &creds
+		if err := t.save(&creds); err != nil {
+			slog.Warn("failed to save refreshed credentials", "error", err)
+		}
+		slog.Debug("access token refreshed", "expires_in_ms", resp.ExpiresInMS)
+		return creds.AccessToken, nil
+	}
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms"`
+}
+
+// exchange calls /refresh with refreshToken. It fails with ErrReauthRequired
+// if the homeserver rejects the token.
+func (t *tokenRefresher) exchange(ctx context.Context, refreshToken string) (*refreshResponse, error) {
+	reqBody, err := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.client.BuildClientURL("v3", "refresh"), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh access token: %w", err)
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh access token: %w", err)
+	}
+	if httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden {
+		// The refresh token was revoked or already used.
+		return nil, ErrReauthRequired
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to refresh access token: HTTP %d: %s", httpResp.StatusCode, body)
+	}
+	var resp refreshResponse
+	if err := json.Unmarshal(body, &resp); err != nil || resp.AccessToken == "" {
+		return nil, fmt.Errorf("failed to refresh access token: invalid response")
+	}
+	return &resp, nil
+}
+
+// reload replaces the credentials with the saved ones if their refresh token
+// differs, reporting whether it did. It must be called with mu held.
+func (t *tokenRefresher) reload() bool {
+	if t.load == nil {
+		return false
+	}
+	creds, err := t.load()
+	if err != nil {
+		slog.Warn("failed to reload credentials", "error", err)
+		return false
+	}
+	if creds == nil || creds.AccessToken == "" || creds.RefreshToken == t.creds.RefreshToken {
+		return false
+	}
+	slog.Debug("using credentials refreshed by another process")
+	t.creds = creds
+	return true
+}
+
+// expiring reports whether the access token in creds expires within
+// refreshMargin.
+func expiring(creds *MatrixCredentials) bool {
+	return creds.ExpiresAt != 0 && time.Until(time.UnixMilli(creds.ExpiresAt)) <= refreshMargin
+}
+
+// withToken returns a copy of req authenticated with token.
+func withToken(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// expiresAt turns a token lifetime into the Unix millisecond timestamp stored
+// in MatrixCredentials.ExpiresAt, 0 if the token doesn't expire.
+func expiresAt(expiresInMS int64) int64 {
+	if expiresInMS <= 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(expiresInMS) * time.Millisecond).UnixMilli()
+}
@@ -0,0 +1,151 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// newRefreshServer fakes a homeserver that only accepts the access token
+// "new", which it hands out for the refresh token "r1".
+func newRefreshServer(t *testing.T, refreshes *int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/refresh":
+			*refreshes++
+			var req struct {
+				RefreshToken string `json:"refresh_token"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.RefreshToken != "r1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"errcode": "M_UNKNOWN_TOKEN", "error": "Unknown refresh token"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "new", "refresh_token": "r2", "expires_in_ms": 300000})
+		case "/_matrix/client/v3/account/whoami":
+			if r.Header.Get("Authorization") != "Bearer new" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]any{"errcode": "M_UNKNOWN_TOKEN", "error": "Token expired", "soft_logout": true})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"user_id": "@bot:example.org", "device_id": "DEVICE"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newRefreshClient creates a client for srv whose saved credentials are
+// *saved, nil until the refresher saves some.
+func newRefreshClient(t *testing.T, srv *httptest.Server, creds *MatrixCredentials, saved **MatrixCredentials) *mautrix.Client {
+	t.Helper()
+	client, err := mautrix.NewClient(srv.URL, "@bot:example.org", creds.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func() (*MatrixCredentials, error) {
+		return *saved, nil
+	}
+	client.Client.Transport = newTokenRefresher(client, creds, load, func(c *MatrixCredentials) error {
+		*saved = c
+		return nil
+	})
+	return client
+}
+
+func TestTokenRefresher_RefreshesRejectedToken(t *testing.T) {
+	var refreshes int
+	srv := newRefreshServer(t, &refreshes)
+	var saved *MatrixCredentials
+	client := newRefreshClient(t, srv, &MatrixCredentials{AccessToken: "old", RefreshToken: "r1"}, &saved)
+
+	if _, err := client.Whoami(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshes)
+	}
+	if saved == nil || saved.AccessToken != "new" || saved.RefreshToken != "r2" || saved.ExpiresAt == 0 {
+		t.Errorf("saved %+v, want the new tokens and expiry", saved)
+	}
+	if _, err := client.Whoami(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times after a second request, want 1", refreshes)
+	}
+}
+
+func TestTokenRefresher_RefreshesBeforeExpiry(t *testing.T) {
+	var refreshes int
+	srv := newRefreshServer(t, &refreshes)
+	var saved *MatrixCredentials
+	expiry := time.Now().Add(refreshMargin / 2).UnixMilli()
+	client := newRefreshClient(t, srv, &MatrixCredentials{AccessToken: "old", RefreshToken: "r1", ExpiresAt: expiry}, &saved)
+
+	if _, err := client.Whoami(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Whoami(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshes)
+	}
+}
+
+func TestTokenRefresher_ReauthRequired(t *testing.T) {
+	for _, creds := range []*MatrixCredentials{
+		{AccessToken: "old"},                     // no refresh token
+		{AccessToken: "old", RefreshToken: "r0"}, // revoked refresh token
+	} {
+		var refreshes int
+		srv := newRefreshServer(t, &refreshes)
+		var saved *MatrixCredentials
+		client := newRefreshClient(t, srv, creds, &saved)
+
+		_, err := client.Whoami(context.Background())
+		if !errors.Is(err, ErrReauthRequired) {
+			t.Errorf("with refresh token %q: got %v, want ErrReauthRequired", creds.RefreshToken, err)
+		}
+		if saved != nil {
+			t.Errorf("with refresh token %q: saved %+v", creds.RefreshToken, saved)
+		}
+	}
+}
+
+func TestTokenRefresher_ReloadsRotatedCredentials(t *testing.T) {
+	var refreshes int
+	srv := newRefreshServer(t, &refreshes)
+	// Another process used the refresh token "r0" and saved the new tokens.
+	saved := &MatrixCredentials{AccessToken: "new", RefreshToken: "r2"}
+	client := newRefreshClient(t, srv, &MatrixCredentials{AccessToken: "old", RefreshToken: "r0"}, &saved)
+
+	if _, err := client.Whoami(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshes)
+	}
+
+	// The saved access token has expired too, but its refresh token works.
+	refreshes = 0
+	saved = &MatrixCredentials{AccessToken: "older", RefreshToken: "r1", ExpiresAt: time.Now().UnixMilli()}
+	client = newRefreshClient(t, srv, &MatrixCredentials{AccessToken: "old", RefreshToken: "r0"}, &saved)
+	if _, err := client.Whoami(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 2 || saved.AccessToken != "new" {
+		t.Errorf("refreshed %d times and saved %+v, want 2 and the new tokens", refreshes, saved)
+	}
+}
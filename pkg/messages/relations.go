@@ -0,0 +1,69 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// setRelation adds an m.relates_to to content replying to replyTo and/or
+// posting in the thread rooted at threadID. Replies get a quoted fallback of
+// the original message when it can be fetched.
+func (p *MatrixProvider) setRelation(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent, replyTo, threadID id.EventID) {
+	rel := content.GetRelatesTo()
+	if threadID != "" {
+		// Clients without thread support see the message as a reply to the
+		// thread root unless it explicitly replies to something else.
+		rel.SetThread(threadID, threadID)
+		if replyTo == "" {
+			return
+		}
+	}
+	orig, err := p.fetchEvent(ctx, roomID, replyTo)
+	if err != nil {
+		slog.Debug("sending reply without fallback", "event_id", replyTo, "error", err)
+		rel.SetReplyTo(replyTo)
+		return
+	}
+	content.SetReply(orig)
+	if origContent := orig.Content.AsMessage(); origContent != nil {
+		addReplyFallback(content, orig, origContent)
+	}
+}
+
+// addReplyFallback prepends the quoted original message to body and
+// formatted_body so clients without reply support still show context.
+func addReplyFallback(content *event.MessageEventContent, orig *event.Event, origContent *event.MessageEventContent) {
+	origContent.RemoveReplyFallback()
+
+	var body strings.Builder
+	for i, line := range strings.Split(origContent.Body, "\n") {
+		if i == 0 {
+			fmt.Fprintf(&body, "> <%s> %s\n", orig.Sender, line)
+		} else {
+			fmt.Fprintf(&body, "> %s\n", line)
+		}
+	}
+	body.WriteString("\n")
+	body.WriteString(content.Body)
+
+	origHTML := origContent.FormattedBody
+	if origContent.Format != event.FormatHTML || origHTML == "" {
+		origHTML = event.TextToHTML(origContent.Body)
+	}
+	content.EnsureHasHTML()
+	content.FormattedBody = fmt.Sprintf(
+		`<mx-reply><blockquote><a href="%s">In reply to</a> <a href="%s">%s</a><br/>%s</blockquote></mx-reply>%s`,
+		orig.RoomID.EventURI(orig.ID).MatrixToURL(),
+		orig.Sender.URI().MatrixToURL(),
+		html.EscapeString(string(orig.Sender)),
+		origHTML,
+		content.FormattedBody,
+	)
+	content.Body = body.String()
+}
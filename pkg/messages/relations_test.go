@@ -0,0 +1,38 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestAddReplyFallback(t *testing.T) {
+	orig := &event.Event{
+		ID:     "$orig",
+		RoomID: "!room:example.org",
+		Sender: "@alice:example.org",
+	}
+	origContent := &event.MessageEventContent{MsgType: event.MsgText, Body: "is the build\nbroken?"}
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "yes"}
+
+	addReplyFallback(content, orig, origContent)
+
+	wantBody := "> <@alice:example.org> is the build\n> broken?\n\nyes"
+	if content.Body != wantBody {
+		t.Errorf("body: got %q, want %q", content.Body, wantBody)
+	}
+	if content.Format != event.FormatHTML {
+		t.Errorf("format: got %q, want %q", content.Format, event.FormatHTML)
+	}
+	if !strings.HasPrefix(content.FormattedBody, "<mx-reply>") || !strings.HasSuffix(content.FormattedBody, "</mx-reply>yes") {
+		t.Errorf("formatted body: got %q", content.FormattedBody)
+	}
+
+	// The fallback must be stripped again on the receiving side.
+	content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(orig.ID)
+	content.RemoveReplyFallback()
+	if content.Body != "yes" || content.FormattedBody != "yes" {
+		t.Errorf("after removing fallback: got body=%q formatted=%q", content.Body, content.FormattedBody)
+	}
+}
@@ -0,0 +1,346 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+)
+
+// syncFreshness is how long a completed sync is trusted before Send does
+// another catch-up sync.
+const syncFreshness = 30 * time.Second
+
+// sentEventTTL is how long the event sent for a transaction ID is
+// remembered, so that the transaction isn't sent again.
+const sentEventTTL = 7 * 24 * time.Hour
+
+// syncStore persists sync state for an account in a SQLite database next to
+// crypto.db: the next_batch token, the filter ID, the room state (members
+// and encryption settings) the crypto helper needs to encrypt messages and
+// the room name state and summaries used to compute display names. It also
+// holds the listen checkpoint: the sync token up to which Listen's output
+// has been handled plus the messages handled after it, used by
+// ListenOptions.Resume, and the events sent with a caller-supplied
+// transaction ID.
+// Device lists are tracked by the crypto store, which is updated from the
+// same sync responses.
+type syncStore struct {
+	db    *dbutil.Database
+	state *sqlstatestore.SQLStateStore
+}
+
+var _ mautrix.SyncStore = (*syncStore)(nil)
+
+func newSyncStore(path string) (*syncStore, error) {
+	db, err := dbutil.NewWithDialect(fmt.Sprintf("file:%s?_txlock=immediate", path), "sqlite3-fk-wal")
+	if err != nil {
+		return nil, err
+	}
+	return &syncStore{
+		db:    db,
+		state: sqlstatestore.NewSQLStateStore(db, dbutil.NoopLogger, false),
+	}, nil
+}
+
+// Upgrade creates or migrates the sync store tables.
+func (s *syncStore) Upgrade(ctx context.Context) error {
+	if err := s.state.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade state store: %w", err)
+	}
+	_, err := s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS sync_state (
+			user_id    TEXT PRIMARY KEY,
+			filter_id  TEXT NOT NULL DEFAULT '',
+			next_batch TEXT NOT NULL DEFAULT '',
+			synced_at  BIGINT NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create sync_state table: %w", err)
+	}
+	_, err = s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS room_names (
+			room_id         TEXT PRIMARY KEY,
+			name            TEXT NOT NULL DEFAULT '',
+			canonical_alias TEXT NOT NULL DEFAULT ''
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create room_names table: %w", err)
+	}
+	_, err = s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS room_summaries (
+			room_id       TEXT PRIMARY KEY,
+			heroes        TEXT,
+			joined_count  INTEGER,
+			invited_count INTEGER
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create room_summaries table: %w", err)
+	}
+	_, err = s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS listen_checkpoint (
+			user_id    TEXT PRIMARY KEY,
+			next_batch TEXT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create listen_checkpoint table: %w", err)
+	}
+	_, err = s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS listen_handled (
+			user_id TEXT NOT NULL,
+			msg_key TEXT NOT NULL,
+			PRIMARY KEY (user_id, msg_key)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create listen_handled table: %w", err)
+	}
+	// sent_events was keyed on the transaction ID alone; it is replaced by
+	// sent_transactions.
+	_, err = s.db.Exec(ctx, `DROP TABLE IF EXISTS sent_events`)
+	if err != nil {
+		return fmt.Errorf("failed to drop sent_events table: %w", err)
+	}
+	_, err = s.db.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS sent_transactions (
+			room_id  TEXT NOT NULL,
+			txn_id   TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			sent_at  TEXT NOT NULL,
+			PRIMARY KEY (room_id, txn_id)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create sent_transactions table: %w", err)
+	}
+	return nil
+}
+
+func (s *syncStore) SaveFilterID(ctx context.Context, userID id.UserID, filterID string) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO sync_state (user_id, filter_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET filter_id=excluded.filter_id`,
+		userID, filterID)
+	return err
+}
+
+func (s *syncStore) LoadFilterID(ctx context.Context, userID id.UserID) (string, error) {
+	var filterID string
+	err := s.db.QueryRow(ctx, `SELECT filter_id FROM sync_state WHERE user_id=$1`, userID).Scan(&filterID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return filterID, err
+}
+
+// SaveNextBatch stores the sync token and marks the state as synced now.
+func (s *syncStore) SaveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO sync_state (user_id, next_batch, synced_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET next_batch=excluded.next_batch, synced_at=excluded.synced_at`,
+		userID, nextBatchToken, time.Now().UnixMilli())
+	return err
+}
+
+func (s *syncStore) LoadNextBatch(ctx context.Context, userID id.UserID) (string, error) {
+	var nextBatch string
+	err := s.db.QueryRow(ctx, `SELECT next_batch FROM sync_state WHERE user_id=$1`, userID).Scan(&nextBatch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return nextBatch, err
+}
+
+// LastSync returns when the sync token was last saved, or the zero time if
+// the account has never synced.
+func (s *syncStore) LastSync(ctx context.Context, userID id.UserID) (time.Time, error) {
+	var syncedAt int64
+	err := s.db.QueryRow(ctx, `SELECT synced_at FROM sync_state WHERE user_id=$1`, userID).Scan(&syncedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	} else if syncedAt == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(syncedAt), nil
+}
+
+// SaveCheckpoint stores the sync token up to which Listen's output has been
+// handled, forgetting the messages recorded by SaveHandled, which all came
+// before it.
+func (s *syncStore) SaveCheckpoint(ctx context.Context, userID id.UserID, nextBatch string) error {
+	return s.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := s.db.Exec(ctx, `
+			INSERT INTO listen_checkpoint (user_id, next_batch) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET next_batch=excluded.next_batch`,
+			userID, nextBatch)
+		if err != nil {
+			return err
+		}
+		_, err = s.db.Exec(ctx, `DELETE FROM listen_handled WHERE user_id=$1`, userID)
+		return err
+	})
+}
+
+// LoadCheckpoint returns the listen checkpoint, or "" if none was saved.
+func (s *syncStore) LoadCheckpoint(ctx context.Context, userID id.UserID) (string, error) {
+	var nextBatch string
+	err := s.db.QueryRow(ctx, `SELECT next_batch FROM listen_checkpoint WHERE user_id=$1`, userID).Scan(&nextBatch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return nextBatch, err
+}
+
+// SaveHandled records that the message with the given key, received after
+// the listen checkpoint, has been handled.
+func (s *syncStore) SaveHandled(ctx context.Context, userID id.UserID, key string) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO listen_handled (user_id, msg_key) VALUES ($1, $2)
+		ON CONFLICT (user_id, msg_key) DO NOTHING`,
+		userID, key)
+	return err
+}
+
+// LoadHandled returns the keys recorded by SaveHandled since the listen
+// checkpoint was last saved.
+func (s *syncStore) LoadHandled(ctx context.Context, userID id.UserID) (map[string]bool, error) {
+	rows, err := s.db.Query(ctx, `SELECT msg_key FROM listen_handled WHERE user_id=$1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	handled := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		handled[key] = true
+	}
+	return handled, rows.Err()
+}
+
+// SaveSentEvent records the event sent to result.RoomID for a transaction
+// ID, and forgets the transactions sent more than sentEventTTL ago.
+func (s *syncStore) SaveSentEvent(ctx context.Context, txnID string, result *SendResult) error {
+	return s.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		// Times are all RFC 3339 in UTC, so they sort as strings.
+		cutoff := time.Now().Add(-sentEventTTL).UTC().Format(time.RFC3339)
+		if _, err := s.db.Exec(ctx, `DELETE FROM sent_transactions WHERE sent_at < $1`, cutoff); err != nil {
+			return err
+		}
+		_, err := s.db.Exec(ctx, `
+			INSERT INTO sent_transactions (room_id, txn_id, event_id, sent_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (room_id, txn_id) DO NOTHING`,
+			result.RoomID, txnID, result.EventID, result.SentAt)
+		return err
+	})
+}
+
+// GetSentEvent returns the event sent to a room for a transaction ID, or nil
+// if none was.
+func (s *syncStore) GetSentEvent(ctx context.Context, roomID, txnID string) (*SendResult, error) {
+	result := SendResult{RoomID: roomID}
+	err := s.db.QueryRow(ctx, `SELECT event_id, sent_at FROM sent_transactions WHERE room_id=$1 AND txn_id=$2`, roomID, txnID).
+		Scan(&result.EventID, &result.SentAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SetRoomName stores the m.room.name of a room.
+func (s *syncStore) SetRoomName(ctx context.Context, roomID id.RoomID, name string) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO room_names (room_id, name) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET name=excluded.name`,
+		roomID, name)
+	return err
+}
+
+// SetCanonicalAlias stores the m.room.canonical_alias of a room.
+func (s *syncStore) SetCanonicalAlias(ctx context.Context, roomID id.RoomID, alias id.RoomAlias) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO room_names (room_id, canonical_alias) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET canonical_alias=excluded.canonical_alias`,
+		roomID, alias)
+	return err
+}
+
+// GetRoomNameState returns the stored name and canonical alias of a room.
+// found is false if neither has been seen in the sync stream.
+func (s *syncStore) GetRoomNameState(ctx context.Context, roomID id.RoomID) (name string, alias id.RoomAlias, found bool, err error) {
+	err = s.db.QueryRow(ctx, `SELECT name, canonical_alias FROM room_names WHERE room_id=$1`, roomID).Scan(&name, &alias)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", false, nil
+	} else if err != nil {
+		return "", "", false, err
+	}
+	return name, alias, true, nil
+}
+
+// InitRoomNameState stores the name and canonical alias of a room fetched
+// from the homeserver, unless the sync stream already stored some.
+func (s *syncStore) InitRoomNameState(ctx context.Context, roomID id.RoomID, name string, alias id.RoomAlias) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO room_names (room_id, name, canonical_alias) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id) DO NOTHING`,
+		roomID, name, alias)
+	return err
+}
+
+// SetRoomSummary stores the summary of a room from a sync response. Fields
+// missing from summary are unchanged since the last one and keep their
+// stored value.
+func (s *syncStore) SetRoomSummary(ctx context.Context, roomID id.RoomID, summary *mautrix.LazyLoadSummary) error {
+	var heroes *string
+	if summary.Heroes != nil {
+		data, err := json.Marshal(summary.Heroes)
+		if err != nil {
+			return err
+		}
+		str := string(data)
+		heroes = &str
+	}
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO room_summaries (room_id, heroes, joined_count, invited_count) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id) DO UPDATE SET
+			heroes=COALESCE(excluded.heroes, room_summaries.heroes),
+			joined_count=COALESCE(excluded.joined_count, room_summaries.joined_count),
+			invited_count=COALESCE(excluded.invited_count, room_summaries.invited_count)`,
+		roomID, heroes, summary.JoinedMemberCount, summary.InvitedMemberCount)
+	return err
+}
+
+// GetRoomSummary returns the stored summary of a room, or nil if none has
+// been seen in the sync stream.
+func (s *syncStore) GetRoomSummary(ctx context.Context, roomID id.RoomID) (*mautrix.LazyLoadSummary, error) {
+	var summary mautrix.LazyLoadSummary
+	var heroes *string
+	err := s.db.QueryRow(ctx, `SELECT heroes, joined_count, invited_count FROM room_summaries WHERE room_id=$1`, roomID).
+		Scan(&heroes, &summary.JoinedMemberCount, &summary.InvitedMemberCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if heroes != nil {
+		if err := json.Unmarshal([]byte(*heroes), &summary.Heroes); err != nil {
+			return nil, err
+		}
+	}
+	return &summary, nil
+}
+
+func (s *syncStore) Close() error {
+	return s.db.Close()
+}
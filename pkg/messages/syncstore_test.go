@@ -0,0 +1,260 @@
+package messages
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestSyncStore(t *testing.T) *syncStore {
+	t.Helper()
+	store, err := newSyncStore(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Upgrade(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSyncStore_Empty(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+	user := id.UserID("@bot:example.org")
+
+	nextBatch, err := store.LoadNextBatch(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextBatch != "" {
+		t.Errorf("next batch: got %q, want empty", nextBatch)
+	}
+	lastSync, err := store.LastSync(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastSync.IsZero() {
+		t.Errorf("last sync: got %v, want zero", lastSync)
+	}
+}
+
+func TestSyncStore_SaveLoad(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+	user := id.UserID("@bot:example.org")
+
+	if err := store.SaveFilterID(ctx, user, "filter1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveNextBatch(ctx, user, "s1_2_3"); err != nil {
+		t.Fatal(err)
+	}
+
+	filterID, err := store.LoadFilterID(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filterID != "filter1" {
+		t.Errorf("filter ID: got %q, want %q", filterID, "filter1")
+	}
+	nextBatch, err := store.LoadNextBatch(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextBatch != "s1_2_3" {
+		t.Errorf("next batch: got %q, want %q", nextBatch, "s1_2_3")
+	}
+	lastSync, err := store.LastSync(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(lastSync) > time.Minute {
+		t.Errorf("last sync: got %v, want recent", lastSync)
+	}
+}
+
+func TestSyncStore_RoomNames(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+	room := id.RoomID("!room:example.org")
+
+	_, _, found, err := store.GetRoomNameState(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected room to be unknown")
+	}
+
+	if err := store.SetCanonicalAlias(ctx, room, "#general:example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetRoomName(ctx, room, "General"); err != nil {
+		t.Fatal(err)
+	}
+	name, alias, found, err := store.GetRoomNameState(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || name != "General" || alias != "#general:example.org" {
+		t.Errorf("got %q/%q/%v, want General/#general:example.org/true", name, alias, found)
+	}
+}
+
+func TestSyncStore_Checkpoint(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+	user := id.UserID("@bot:example.org")
+
+	checkpoint, err := store.LoadCheckpoint(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != "" {
+		t.Errorf("checkpoint: got %q, want empty", checkpoint)
+	}
+	if err := store.SaveCheckpoint(ctx, user, "s4_5_6"); err != nil {
+		t.Fatal(err)
+	}
+	// The sync loop's own token is tracked separately.
+	if err := store.SaveNextBatch(ctx, user, "s7_8_9"); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err = store.LoadCheckpoint(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != "s4_5_6" {
+		t.Errorf("checkpoint: got %q, want %q", checkpoint, "s4_5_6")
+	}
+
+	// Messages handled after the checkpoint are forgotten once it moves on.
+	if err := store.SaveHandled(ctx, user, "message $a"); err != nil {
+		t.Fatal(err)
+	}
+	handled, err := store.LoadHandled(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || !handled["message $a"] {
+		t.Errorf("handled: got %v, want message $a", handled)
+	}
+	if err := store.SaveCheckpoint(ctx, user, "s10_11_12"); err != nil {
+		t.Fatal(err)
+	}
+	handled, err = store.LoadHandled(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 0 {
+		t.Errorf("handled after a new checkpoint: got %v, want none", handled)
+	}
+}
+
+func TestSyncStore_SentEvents(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+
+	sent, err := store.GetSentEvent(ctx, "!room:example.org", "alert-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != nil {
+		t.Fatalf("got %+v, want nil for an unknown transaction", sent)
+	}
+	old := &SendResult{RoomID: "!room:example.org", EventID: "$old", SentAt: time.Now().Add(-sentEventTTL - time.Hour).UTC().Format(time.RFC3339)}
+	if err := store.SaveSentEvent(ctx, "alert-0", old); err != nil {
+		t.Fatal(err)
+	}
+	want := &SendResult{RoomID: "!room:example.org", EventID: "$abc", SentAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := store.SaveSentEvent(ctx, "alert-1", want); err != nil {
+		t.Fatal(err)
+	}
+	sent, err = store.GetSentEvent(ctx, "!room:example.org", "alert-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent == nil || *sent != *want {
+		t.Errorf("got %+v, want %+v", sent, want)
+	}
+	// The same transaction ID in another room is a different transaction.
+	sent, err = store.GetSentEvent(ctx, "!other:example.org", "alert-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != nil {
+		t.Errorf("got %+v for another room, want nil", sent)
+	}
+	// Transactions older than sentEventTTL are forgotten.
+	sent, err = store.GetSentEvent(ctx, "!room:example.org", "alert-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != nil {
+		t.Errorf("got %+v for an expired transaction, want nil", sent)
+	}
+}
+
+func TestSyncStore_RoomSummary(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+	room := id.RoomID("!room:example.org")
+
+	summary, err := store.GetRoomSummary(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != nil {
+		t.Errorf("got %+v, want no summary", summary)
+	}
+	joined, invited := 3, 1
+	err = store.SetRoomSummary(ctx, room, &mautrix.LazyLoadSummary{
+		Heroes:             []id.UserID{"@alice:example.org", "@bob:example.org"},
+		JoinedMemberCount:  &joined,
+		InvitedMemberCount: &invited,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A later summary only carries the fields that changed.
+	joined = 4
+	if err := store.SetRoomSummary(ctx, room, &mautrix.LazyLoadSummary{JoinedMemberCount: &joined}); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = store.GetRoomSummary(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary == nil || len(summary.Heroes) != 2 || summary.Heroes[1] != "@bob:example.org" ||
+		summary.JoinedMemberCount == nil || *summary.JoinedMemberCount != 4 ||
+		summary.InvitedMemberCount == nil || *summary.InvitedMemberCount != 1 {
+		t.Errorf("got %+v, want both heroes, 4 joined and 1 invited", summary)
+	}
+}
+
+func TestSyncStore_InitRoomNameState(t *testing.T) {
+	store := newTestSyncStore(t)
+	ctx := context.Background()
+	room := id.RoomID("!room:example.org")
+
+	if err := store.SetRoomName(ctx, room, "General"); err != nil {
+		t.Fatal(err)
+	}
+	// A name fetched before the sync stream stored one doesn't replace it.
+	if err := store.InitRoomNameState(ctx, room, "Old name", "#old:example.org"); err != nil {
+		t.Fatal(err)
+	}
+	name, alias, found, err := store.GetRoomNameState(ctx, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || name != "General" || alias != "" {
+		t.Errorf("got %q/%q/%v, want General with no alias", name, alias, found)
+	}
+}
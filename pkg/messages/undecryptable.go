@@ -0,0 +1,94 @@
+package messages
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxUndecryptable is the number of undecryptable events Listen holds for
+// decrypting again when their room key arrives late. Beyond it, events are
+// still emitted as undecryptable but not retried.
+const maxUndecryptable = 1000
+
+// undecryptableEvents holds the events Listen couldn't decrypt, by the
+// Megolm session they need.
+type undecryptableEvents struct {
+	mu     sync.Mutex
+	events map[id.SessionID][]*event.Event
+	count  int
+}
+
+func newUndecryptableEvents() *undecryptableEvents {
+	return &undecryptableEvents{events: make(map[id.SessionID][]*event.Event)}
+}
+
+// add holds evt until take is called for its session. It returns false if
+// maxUndecryptable events are already held.
+func (u *undecryptableEvents) add(sessionID id.SessionID, evt *event.Event) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count >= maxUndecryptable {
+		return false
+	}
+	u.events[sessionID] = append(u.events[sessionID], evt)
+	u.count++
+	return true
+}
+
+// take removes and returns the events held for a session.
+func (u *undecryptableEvents) take(sessionID id.SessionID) []*event.Event {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	evts := u.events[sessionID]
+	delete(u.events, sessionID)
+	u.count -= len(evts)
+	return evts
+}
+
+// handleUndecryptable emits an event the crypto helper couldn't decrypt as a
+// TypeUndecryptable message and holds it for retryUndecryptable.
+func (p *MatrixProvider) handleUndecryptable(ctx context.Context, listener *listenSyncer, utd *undecryptableEvents, evt *event.Event, err error) {
+	content := evt.Content.AsEncrypted()
+	slog.Debug("undecryptable event", "event_id", evt.ID, "session_id", content.SessionID, "error", err)
+	if !utd.add(content.SessionID, evt) {
+		slog.Warn("too many undecryptable events, not retrying", "event_id", evt.ID)
+	}
+	if evt.Sender == p.userID {
+		return
+	}
+	listener.emit(ctx, IncomingMessage{
+		Type:       TypeUndecryptable,
+		RoomID:     string(evt.RoomID),
+		RoomName:   p.getRoomDisplayName(ctx, evt.RoomID),
+		Sender:     string(evt.Sender),
+		SenderName: p.getSenderName(ctx, evt.RoomID, evt.Sender),
+		SessionID:  string(content.SessionID),
+		Reason:     err.Error(),
+		Timestamp:  time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
+		EventID:    string(evt.ID),
+	})
+}
+
+// retryUndecryptable decrypts the held events of a session whose key just
+// arrived, e.g. forwarded by another device or restored from the key backup,
+// and emits them marked as late. Events that still fail are held again.
+func (p *MatrixProvider) retryUndecryptable(ctx context.Context, listener *listenSyncer, utd *undecryptableEvents, sessionID id.SessionID, opts ListenOptions) {
+	for _, evt := range utd.take(sessionID) {
+		decrypted, err := p.cryptoHelper.Decrypt(ctx, evt)
+		if err != nil {
+			slog.Debug("still can't decrypt event", "event_id", evt.ID, "session_id", sessionID, "error", err)
+			utd.add(sessionID, evt)
+			continue
+		}
+		slog.Debug("decrypted event after its key arrived", "event_id", evt.ID, "session_id", sessionID)
+		if msg := p.toListenMessage(ctx, decrypted, opts); msg != nil {
+			msg.Late = true
+			listener.emit(ctx, *msg)
+		}
+	}
+}
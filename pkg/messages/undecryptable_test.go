@@ -0,0 +1,60 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestHandleUndecryptable(t *testing.T) {
+	var saved []string
+	listener, ch := newTestListenSyncer(&saved)
+	p := &MatrixProvider{names: newNameCache(), userID: "@bot:example.org"}
+	p.names.setRoom("!room:example.org", "General")
+	p.names.setMember("!room:example.org", "@alice:example.org", "Alice")
+	utd := newUndecryptableEvents()
+
+	content, _ := json.Marshal(map[string]string{"algorithm": "m.megolm.v1.aes-sha2", "session_id": "sess1", "ciphertext": "x"})
+	evt := &event.Event{
+		ID:      "$utd",
+		RoomID:  "!room:example.org",
+		Sender:  "@alice:example.org",
+		Type:    event.EventEncrypted,
+		Content: event.Content{VeryRaw: content},
+	}
+	if err := evt.Content.ParseRaw(evt.Type); err != nil {
+		t.Fatal(err)
+	}
+	go p.handleUndecryptable(context.Background(), listener, utd, evt, crypto.ErrNoSessionFound)
+
+	msg := <-ch
+	if msg.Type != TypeUndecryptable || msg.SessionID != "sess1" || msg.EventID != "$utd" || msg.SenderName != "Alice" || msg.Reason == "" {
+		t.Errorf("got %+v", msg)
+	}
+	if held := utd.take("sess1"); len(held) != 1 || held[0] != evt {
+		t.Errorf("held events for sess1: %v", held)
+	}
+	if held := utd.take("sess1"); len(held) != 0 {
+		t.Errorf("events held again after take: %v", held)
+	}
+}
+
+func TestUndecryptableEvents_Limit(t *testing.T) {
+	utd := newUndecryptableEvents()
+	for i := range maxUndecryptable {
+		if !utd.add([]id.SessionID{"a", "b"}[i%2], &event.Event{}) {
+			t.Fatalf("event %d not held", i)
+		}
+	}
+	if utd.add("c", &event.Event{}) {
+		t.Error("held more than maxUndecryptable events")
+	}
+	utd.take("a")
+	if !utd.add("c", &event.Event{}) {
+		t.Error("taking events didn't make room")
+	}
+}
@@ -0,0 +1,162 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"maunium.net/go/mautrix/crypto/verificationhelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// verifyEvent is something that happened to a verification, passed from the
+// verification helper's callbacks to Verify.
+type verifyEvent struct {
+	txnID    id.VerificationTransactionID
+	kind     string // "requested", "ready", "sas", "done" or "cancelled"
+	userID   id.UserID
+	deviceID id.DeviceID
+	sas      SAS
+	err      error
+}
+
+// verifyCallbacks implements the verification helper's callbacks. They are
+// called with the helper's lock held, so they only queue the event.
+type verifyCallbacks struct {
+	events chan verifyEvent
+}
+
+func (c *verifyCallbacks) queue(evt verifyEvent) {
+	select {
+	case c.events <- evt:
+	default:
+		// Verify has stopped reading; don't block the sync loop.
+		slog.Warn("dropping verification event", "transaction_id", evt.txnID, "kind", evt.kind)
+	}
+}
+
+func (c *verifyCallbacks) VerificationRequested(ctx context.Context, txnID id.VerificationTransactionID, from id.UserID, fromDevice id.DeviceID) {
+	c.queue(verifyEvent{txnID: txnID, kind: "requested", userID: from, deviceID: fromDevice})
+}
+
+func (c *verifyCallbacks) VerificationReady(ctx context.Context, txnID id.VerificationTransactionID, otherDeviceID id.DeviceID, supportsSAS, supportsScanQRCode bool, qrCode *verificationhelper.QRCode) {
+	var err error
+	if !supportsSAS {
+		err = errors.New("the other device doesn't support emoji or number verification")
+	}
+	c.queue(verifyEvent{txnID: txnID, kind: "ready", deviceID: otherDeviceID, err: err})
+}
+
+func (c *verifyCallbacks) ShowSAS(ctx context.Context, txnID id.VerificationTransactionID, emojis []rune, emojiDescriptions []string, decimals []int) {
+	sas := SAS{EmojiNames: emojiDescriptions, Decimals: decimals}
+	for _, e := range emojis {
+		sas.Emoji = append(sas.Emoji, string(e))
+	}
+	c.queue(verifyEvent{txnID: txnID, kind: "sas", sas: sas})
+}
+
+func (c *verifyCallbacks) VerificationCancelled(ctx context.Context, txnID id.VerificationTransactionID, code event.VerificationCancelCode, reason string) {
+	c.queue(verifyEvent{txnID: txnID, kind: "cancelled", err: fmt.Errorf("verification cancelled: %s (%s)", reason, code)})
+}
+
+func (c *verifyCallbacks) VerificationDone(ctx context.Context, txnID id.VerificationTransactionID, method event.VerificationMethod) {
+	c.queue(verifyEvent{txnID: txnID, kind: "done"})
+}
+
+// Verify runs one SAS verification, syncing until it is done. The verified
+// device is marked as trusted in the crypto store; when it is one of our
+// own devices and cross-signing is set up, it is also signed.
+func (p *MatrixProvider) Verify(ctx context.Context, opts VerifyOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	callbacks := &verifyCallbacks{events: make(chan verifyEvent, 16)}
+	helper := verificationhelper.NewVerificationHelper(p.client, p.cryptoHelper.Machine(), nil, callbacks, false, false, true)
+	if err := helper.Init(ctx); err != nil {
+		return fmt.Errorf("failed to init verification: %w", err)
+	}
+
+	syncErr := make(chan error, 1)
+	syncDone := make(chan struct{})
+	go func() {
+		defer close(syncDone)
+		syncErr <- p.client.SyncWithContext(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-syncDone
+	}()
+
+	var txnID id.VerificationTransactionID
+	if opts.UserID != "" {
+		var err error
+		slog.Debug("requesting verification", "user_id", opts.UserID)
+		if txnID, err = helper.StartVerification(ctx, id.UserID(opts.UserID)); err != nil {
+			return fmt.Errorf("failed to request verification: %w", err)
+		}
+	}
+
+	for {
+		var evt verifyEvent
+		select {
+		case evt = <-callbacks.events:
+		case err := <-syncErr:
+			if err == nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("sync stopped during verification: %w", err)
+		case <-ctx.Done():
+			if txnID != "" {
+				helper.CancelVerification(context.Background(), txnID, event.VerificationCancelCodeUser, "The verification was cancelled.")
+			}
+			return ctx.Err()
+		}
+		if evt.kind == "requested" && txnID == "" {
+			if opts.Accept == nil || !opts.Accept(string(evt.userID), string(evt.deviceID)) {
+				if err := helper.DismissVerification(ctx, evt.txnID); err != nil {
+					slog.Warn("failed to dismiss verification request", "error", err)
+				}
+				continue
+			}
+			txnID = evt.txnID
+			if err := helper.AcceptVerification(ctx, txnID); err != nil {
+				return fmt.Errorf("failed to accept verification: %w", err)
+			}
+			continue
+		}
+		if evt.txnID != txnID {
+			slog.Debug("ignoring event for another verification", "transaction_id", evt.txnID, "kind", evt.kind)
+			continue
+		}
+
+		slog.Debug("verification event", "transaction_id", txnID, "kind", evt.kind)
+		switch evt.kind {
+		case "ready":
+			if evt.err != nil {
+				helper.CancelVerification(ctx, txnID, event.VerificationCancelCodeUnknownMethod, evt.err.Error())
+				return evt.err
+			}
+			// The side that sent the request starts SAS once the other
+			// accepts; the accepting side waits for it.
+			if opts.UserID != "" {
+				if err := helper.StartSAS(ctx, txnID); err != nil {
+					return fmt.Errorf("failed to start verification: %w", err)
+				}
+			}
+		case "sas":
+			if opts.Confirm == nil || !opts.Confirm(evt.sas) {
+				helper.CancelVerification(ctx, txnID, event.VerificationCancelCodeSASMismatch, "The emoji or numbers didn't match.")
+				return errors.New("verification cancelled: the emoji or numbers didn't match")
+			}
+			if err := helper.ConfirmSAS(ctx, txnID); err != nil {
+				return fmt.Errorf("failed to confirm verification: %w", err)
+			}
+		case "done":
+			return nil
+		case "cancelled":
+			return evt.err
+		}
+	}
+}
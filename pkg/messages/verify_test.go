@@ -0,0 +1,30 @@
+package messages
+
+import (
+	"context"
+	"testing"
+)
+
+func TestVerifyCallbacks_ShowSAS(t *testing.T) {
+	c := &verifyCallbacks{events: make(chan verifyEvent, 1)}
+	c.ShowSAS(context.Background(), "txn", []rune{'🐶', '🔑'}, []string{"Dog", "Key"}, []int{1234, 5678, 9012})
+
+	evt := <-c.events
+	if evt.kind != "sas" || evt.txnID != "txn" {
+		t.Fatalf("got %s event for %q, want sas for txn", evt.kind, evt.txnID)
+	}
+	if len(evt.sas.Emoji) != 2 || evt.sas.Emoji[0] != "🐶" || evt.sas.EmojiNames[1] != "Key" || evt.sas.Decimals[2] != 9012 {
+		t.Errorf("got SAS %+v", evt.sas)
+	}
+}
+
+func TestVerifyCallbacks_DoesNotBlock(t *testing.T) {
+	c := &verifyCallbacks{events: make(chan verifyEvent, 1)}
+	c.VerificationDone(context.Background(), "a", "")
+	// Nobody is reading; the second event must be dropped rather than block
+	// the sync loop.
+	c.VerificationDone(context.Background(), "b", "")
+	if evt := <-c.events; evt.txnID != "a" {
+		t.Errorf("got event for %q, want a", evt.txnID)
+	}
+}